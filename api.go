@@ -0,0 +1,128 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrNotFound = errors.New("File not found")
+
+// SaveOptions tune a file created by Save.
+type SaveOptions struct {
+	// Role picks the upload policy and the quota of the owner,
+	// empty means the default policy and no role quota.
+	Role string
+	// Visibility is VisibilityPublic (the default) or VisibilityPrivate.
+	Visibility string
+}
+
+// Save stores the content of src as a new file of the owner
+// with the Default service.
+func Save(ctx context.Context, owner int, name string, src io.Reader, opts SaveOptions) (File, error) {
+	return Default.Save(ctx, owner, name, src, opts)
+}
+
+// Delete removes the file with the Default service.
+func Delete(ctx context.Context, id uint) error {
+	return Default.Delete(ctx, id)
+}
+
+// Save stores the content of src as a new file of the owner, with the
+// same checks, processing and events as an upload through the api.
+// It is meant for seeders, importers and other modules.
+func (s *Service) Save(ctx context.Context, owner int, name string, src io.Reader, opts SaveOptions) (File, error) {
+	if opts.Visibility == "" {
+		opts.Visibility = VisibilityPublic
+	}
+
+	if opts.Visibility != VisibilityPublic && opts.Visibility != VisibilityPrivate {
+		return File{}, ErrVisibility
+	}
+
+	file, err := s.store(File{UserID: owner, Visibility: opts.Visibility}, opts.Role, name, src)
+	if err != nil {
+		return File{}, err
+	}
+
+	file, err = s.insert(ctx, file)
+	s.withURLs(&file)
+
+	return file, err
+}
+
+// Delete removes the file and its content, as the api does.
+func (s *Service) Delete(ctx context.Context, id uint) error {
+	var file File
+
+	s.scoped(s.App.DB).First(&file, id)
+	if file.ID == 0 {
+		return ErrNotFound
+	}
+
+	return s.remove(ctx, file)
+}
+
+// insert saves a stored file as a new record, unless a hook rejects it,
+// and schedules its processing.
+func (s *Service) insert(ctx context.Context, file File) (File, error) {
+	if err := s.veto(ctx, EventBeforeUpload, file); err != nil {
+		s.removeBlobs(file)
+		return File{}, err
+	}
+
+	file.Namespace = s.Opts.Namespace
+
+	tx := s.App.DB.Begin()
+	err := tx.Create(&file).Error
+	if err == nil {
+		err = s.publishFile(tx, EventUploaded, file)
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		s.removeBlobs(file)
+		return File{}, err
+	}
+
+	s.enqueue(&file)
+	s.emit(ctx, EventUploaded, file)
+
+	return file, nil
+}
+
+// remove deletes the record and the content of the file,
+// unless a hook rejects it.
+func (s *Service) remove(ctx context.Context, file File) error {
+	if err := s.veto(ctx, EventBeforeDelete, file); err != nil {
+		return err
+	}
+
+	tx := s.App.DB.Begin()
+	if s.App.IsTest {
+		tx = tx.Unscoped()
+	}
+	err := tx.Delete(&file).Error
+	if err == nil {
+		err = s.publishFile(tx, EventDeleted, file)
+	}
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = s.removeBlobs(file)
+
+	s.emit(ctx, EventDeleted, file)
+
+	return err
+}
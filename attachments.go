@@ -2,6 +2,7 @@
 package files
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -13,19 +14,106 @@ import (
 
 type Attachments []Attachment
 
+// Attachment links a file to a group of an owner, any model of the app
+// given by OwnerType, its table as gorm polymorphic relations store it,
+// and OwnerID. Index orders the attachments of a group and owner from 1,
+// at most one of them IsMain.
 type Attachment struct {
 	gorm.Model
 	UserID      int    `json:"userID"`
 	Group       string `json:"group"`
+	OwnerType   string `json:"ownerType" gorm:"type:varchar(100);index:idx_attachment_owner"`
+	OwnerID     uint   `json:"ownerID" gorm:"index:idx_attachment_owner"`
 	FileID      int    `json:"fileID"`
 	Title       string `json:"title"`
 	Description string `json:"description" gorm:"type:text"`
 	IsMain      int    `json:"isMain"`
 	Index       int    `json:"index" gorm:"type:int(6)"`
 	File        File   `json:"file"`
+	Namespace   string `json:"-" gorm:"type:varchar(100);not null;default:'';index"`
 }
 
-func actionAttchGetAll(w http.ResponseWriter, r *http.Request) {
+// AttachmentOrder is the new order of the attachments of a group and
+// owner, IDs lists all of them from first to last.
+type AttachmentOrder struct {
+	Group     string `json:"group"`
+	OwnerType string `json:"ownerType"`
+	OwnerID   uint   `json:"ownerID"`
+	IDs       []uint `json:"ids"`
+}
+
+// siblings selects the attachments of the group and owner of a.
+func (a Attachment) siblings(db *gorm.DB) *gorm.DB {
+	return db.Model(&Attachment{}).
+		Where("namespace = ? AND `group` = ? AND owner_type = ? AND owner_id = ?",
+			a.Namespace, a.Group, a.OwnerType, a.OwnerID)
+}
+
+// lock locks the attachments of the group and owner of a until the end
+// of the transaction tx, so changes of a group run one after another.
+// It returns the last index of the group.
+func (a Attachment) lock(tx *gorm.DB) (int, error) {
+	var last int
+
+	// sqlite has no FOR UPDATE, it locks the whole database on write
+	if tx.Dialect().GetName() != "sqlite3" {
+		tx = tx.Set("gorm:query_option", "FOR UPDATE")
+	}
+
+	err := a.siblings(tx).Select("coalesce(max(`index`), 0)").Row().Scan(&last)
+
+	return last, err
+}
+
+// renumber closes the gaps in the indexes of the group and owner of a,
+// keeping their order.
+func (a Attachment) renumber(tx *gorm.DB) error {
+	var ids []uint
+
+	if err := a.siblings(tx).Order("`index`").Order("id").Pluck("id", &ids).Error; err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		if err := tx.Model(&Attachment{}).Where("id = ?", id).Update("index", i+1).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keepMain clears IsMain on the siblings of a main attachment,
+// so each group and owner has at most one.
+func (a Attachment) keepMain(db *gorm.DB) error {
+	if a.IsMain == 0 {
+		return nil
+	}
+
+	return a.siblings(db).Where("id <> ?", a.ID).Update("is_main", 0).Error
+}
+
+// attachedFile hides the file of the attachment from callers who
+// may not read it, attachments of private files stay listed.
+func (s *Service) attachedFile(r *http.Request, a *Attachment) {
+	if !canRead(r, a.File) {
+		a.File = File{}
+		return
+	}
+
+	s.withURLs(&a.File)
+}
+
+// canAttach checks that the caller may read the file with id.
+func (s *Service) canAttach(r *http.Request, id int) bool {
+	var file File
+
+	s.scoped(s.App.DB).First(&file, id)
+
+	return file.ID != 0 && canRead(r, file)
+}
+
+func (s *Service) actionAttchGetAll(w http.ResponseWriter, r *http.Request) {
 	var (
 		attachments Attachments
 		rsp         = core.Response{Data: &attachments, Req: r}
@@ -33,19 +121,17 @@ func actionAttchGetAll(w http.ResponseWriter, r *http.Request) {
 		id          = r.FormValue("id")
 		group       = r.FormValue("group")
 		fileid      = r.FormValue("fileid")
+		ownertype   = r.FormValue("ownertype")
+		ownerid     = r.FormValue("ownerid")
 		title       = r.FormValue("title")
 		description = r.FormValue("description")
-		sort        = r.FormValue("sort")
-		limit       = r.FormValue("limit")
-		offset      = r.FormValue("offset")
-		db          = App.DB
+		db          = s.scoped(s.App.DB)
 	)
 
 	if all != "" {
-		db = db.Where("id LIKE ?", "%"+all+"%")
-		db = db.Or("title LIKE ?", "%"+all+"%")
-		db = db.Or("description LIKE ?", "%"+all+"%")
-		db = db.Or("content LIKE ?", "%"+all+"%")
+		// grouped, so the other filters apply to every match
+		db = db.Where("id LIKE ? OR title LIKE ? OR description LIKE ?",
+			"%"+all+"%", "%"+all+"%", "%"+all+"%")
 	}
 
 	if id != "" {
@@ -60,6 +146,14 @@ func actionAttchGetAll(w http.ResponseWriter, r *http.Request) {
 		db = db.Where("file_id = ?", fileid)
 	}
 
+	if ownertype != "" {
+		db = db.Where("owner_type = ?", ownertype)
+	}
+
+	if ownerid != "" {
+		db = db.Where("owner_id = ?", ownerid)
+	}
+
 	if title != "" {
 		db = db.Where("title LIKE ?", "%"+title+"%")
 	}
@@ -68,30 +162,27 @@ func actionAttchGetAll(w http.ResponseWriter, r *http.Request) {
 		db = db.Where("description LIKE ?", "%"+description+"%")
 	}
 
-	if sort != "" {
-		db = db.Order(sort)
-	}
-
-	if limit != "" {
-		db = db.Limit(limit)
+	list, err := attachmentList.query(db, r, s.Opts.MaxPageSize)
+	if err != nil {
+		rsp.Errors.Add("query", err.Error())
+	} else {
+		list.find(&attachments, "File")
 	}
 
-	if offset != "" {
-		db = db.Offset(offset)
+	for i := range attachments {
+		s.attachedFile(r, &attachments[i])
 	}
 
-	db.Preload("File").Find(&attachments)
-
-	rsp.Data = &attachments
+	rsp.Data = attachments.Public()
 
-	w.Write(rsp.Make())
+	writeList(w, &rsp, list)
 }
 
-func actionAttachGetOne(w http.ResponseWriter, r *http.Request) {
+func (s *Service) actionAttachGetOne(w http.ResponseWriter, r *http.Request) {
 	var (
 		attachment Attachment
 		rsp        = core.Response{Data: &attachment, Req: r}
-		db         = App.DB
+		db         = s.scoped(s.App.DB)
 	)
 
 	vars := mux.Vars(r)
@@ -103,14 +194,16 @@ func actionAttachGetOne(w http.ResponseWriter, r *http.Request) {
 
 	if attachment.ID == 0 {
 		rsp.Errors.Add("ID", "Attachment not found")
-	} else {
-		rsp.Data = &attachment
 	}
 
+	s.attachedFile(r, &attachment)
+
+	rsp.Data = attachment.Public()
+
 	w.Write(rsp.Make())
 }
 
-func actionAttachCreate(w http.ResponseWriter, r *http.Request) {
+func (s *Service) actionAttachCreate(w http.ResponseWriter, r *http.Request) {
 	var (
 		attachment Attachment
 		rsp        = core.Response{Data: &attachment, Req: r}
@@ -120,16 +213,49 @@ func actionAttachCreate(w http.ResponseWriter, r *http.Request) {
 		if rsp.IsValidate() {
 			userid, _ := strconv.Atoi(r.Header.Get("id"))
 			attachment.UserID = userid
-			App.DB.Create(&attachment)
+			attachment.Namespace = s.Opts.Namespace
+
+			if !s.canAttach(r, attachment.FileID) {
+				attachment = Attachment{}
+				rsp.Errors.Add("fileID", "File not found")
+			} else {
+				// new attachments go last, /attachments/order moves them
+				tx := s.App.DB.Begin()
+				last, err := attachment.lock(tx)
+				if err == nil {
+					attachment.Index = last + 1
+					err = tx.Create(&attachment).Error
+				}
+				if err == nil {
+					err = attachment.keepMain(tx)
+				}
+				if err == nil {
+					err = s.publish(tx, "attachment.created", attachment.Public())
+				}
+				if err == nil {
+					err = tx.Commit().Error
+				} else {
+					tx.Rollback()
+				}
+
+				if err != nil {
+					attachment = Attachment{}
+					rsp.Errors.Add("ID", "Attachment not saved")
+				} else {
+					s.notify()
+				}
+			}
 		}
 	}
 
-	rsp.Data = &attachment
+	s.attachedFile(r, &attachment)
+
+	rsp.Data = attachment.Public()
 
 	w.Write(rsp.Make())
 }
 
-func actionAttachUpdate(w http.ResponseWriter, r *http.Request) {
+func (s *Service) actionAttachUpdate(w http.ResponseWriter, r *http.Request) {
 	var (
 		data       Attachment
 		attachment Attachment
@@ -140,7 +266,7 @@ func actionAttachUpdate(w http.ResponseWriter, r *http.Request) {
 		if rsp.IsValidate() {
 
 			vars := mux.Vars(r)
-			App.DB.First(&attachment, vars["id"])
+			s.scoped(s.App.DB).First(&attachment, vars["id"])
 
 			if attachment.ID == 0 {
 				rsp.Errors.Add("ID", "Attachment not found")
@@ -148,8 +274,14 @@ func actionAttachUpdate(w http.ResponseWriter, r *http.Request) {
 				role := r.Header.Get("role")
 				idstring := fmt.Sprintf("%d", attachment.UserID)
 				userid := r.Header.Get("id")
-				if role == "admin" || (role == "user" && idstring == userid) {
-					App.DB.Model(&attachment).Updates(data)
+				if data.FileID != 0 && !s.canAttach(r, data.FileID) {
+					rsp.Errors.Add("fileID", "File not found")
+				} else if role == "admin" || (role == "user" && idstring == userid) {
+					if err := s.update(&attachment, data); err != nil {
+						rsp.Errors.Add("ID", "Attachment not saved")
+					} else {
+						s.notify()
+					}
 				} else {
 					rsp.Errors.Add("ID", "Only owner can change attachment")
 				}
@@ -157,19 +289,172 @@ func actionAttachUpdate(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	rsp.Data = &attachment
+	s.attachedFile(r, &attachment)
+
+	rsp.Data = attachment.Public()
+
+	w.Write(rsp.Make())
+}
+
+// update changes the attachment to data, except its index which only
+// /attachments/order sets. An attachment moved to another group or owner
+// goes last there and the indexes it leaves are closed.
+func (s *Service) update(attachment *Attachment, data Attachment) error {
+	old := *attachment
+	to := old
+	if data.Group != "" {
+		to.Group = data.Group
+	}
+	if data.OwnerType != "" {
+		to.OwnerType = data.OwnerType
+	}
+	if data.OwnerID != 0 {
+		to.OwnerID = data.OwnerID
+	}
+	moved := to.Group != old.Group || to.OwnerType != old.OwnerType || to.OwnerID != old.OwnerID
+
+	tx := s.App.DB.Begin()
+	defer tx.Rollback()
+
+	data.Index = 0
+	if _, err := old.lock(tx); err != nil {
+		return err
+	}
+	if moved {
+		last, err := to.lock(tx)
+		if err != nil {
+			return err
+		}
+		data.Index = last + 1
+	}
+
+	if err := tx.Model(attachment).Updates(data).Error; err != nil {
+		return err
+	}
+	if moved {
+		if err := old.renumber(tx); err != nil {
+			return err
+		}
+	}
+	if err := attachment.keepMain(tx); err != nil {
+		return err
+	}
+	if err := s.publish(tx, "attachment.updated", attachment.Public()); err != nil {
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// actionAttachOrder rewrites the indexes of the attachments of a group
+// and owner in the order of the ids, all or nothing.
+func (s *Service) actionAttachOrder(w http.ResponseWriter, r *http.Request) {
+	var (
+		data        AttachmentOrder
+		attachments Attachments
+		rsp         = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		if rsp.IsValidate() {
+			group := Attachment{
+				Group:     data.Group,
+				OwnerType: data.OwnerType,
+				OwnerID:   data.OwnerID,
+				Namespace: s.Opts.Namespace,
+			}
+
+			var err error
+			if attachments, err = s.order(r, group, data.IDs); err != nil {
+				rsp.Errors.Add("ids", err.Error())
+			} else {
+				s.notify()
+			}
+		}
+	}
+
+	for i := range attachments {
+		s.attachedFile(r, &attachments[i])
+	}
+
+	rsp.Data = attachments.Public()
 
 	w.Write(rsp.Make())
 }
 
-func actionAttachDelete(w http.ResponseWriter, r *http.Request) {
+var (
+	ErrAttachmentOrder = errors.New("Ids must list every attachment of the group once")
+	ErrAttachmentOwner = errors.New("Only owner can change attachment")
+)
+
+// order sets the index of the attachments of the group to the position
+// of their id and returns them in the new order.
+func (s *Service) order(r *http.Request, group Attachment, ids []uint) (Attachments, error) {
+	var attachments Attachments
+
+	tx := s.App.DB.Begin()
+	defer tx.Rollback()
+
+	if _, err := group.lock(tx); err != nil {
+		return nil, err
+	}
+	group.siblings(tx).Find(&attachments)
+
+	if len(attachments) == 0 || len(ids) != len(attachments) {
+		return nil, ErrAttachmentOrder
+	}
+
+	byID := make(map[uint]Attachment, len(attachments))
+	for _, a := range attachments {
+		byID[a.ID] = a
+	}
+
+	role := r.Header.Get("role")
+	userid := r.Header.Get("id")
+
+	for _, id := range ids {
+		a, ok := byID[id]
+		if !ok {
+			return nil, ErrAttachmentOrder
+		}
+		delete(byID, id)
+
+		idstring := fmt.Sprintf("%d", a.UserID)
+		if !(role == "admin" || (role == "user" && idstring == userid)) {
+			return nil, ErrAttachmentOwner
+		}
+	}
+
+	for i, id := range ids {
+		if err := tx.Model(&Attachment{}).Where("id = ?", id).Update("index", i+1).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	attachments = nil
+	group.siblings(tx).Preload("File").Order("`index`").Order("id").Find(&attachments)
+
+	for _, a := range attachments {
+		if err := s.publish(tx, "attachment.updated", a.Public()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	return attachments, nil
+}
+
+func (s *Service) actionAttachDelete(w http.ResponseWriter, r *http.Request) {
 	var (
 		attachment Attachment
 		rsp        = core.Response{Data: &attachment, Req: r}
 	)
 
 	vars := mux.Vars(r)
-	App.DB.First(&attachment, vars["id"])
+	s.scoped(s.App.DB).First(&attachment, vars["id"])
 
 	if attachment.ID == 0 {
 		rsp.Errors.Add("ID", "Contentattachment not found")
@@ -178,17 +463,40 @@ func actionAttachDelete(w http.ResponseWriter, r *http.Request) {
 		idstring := fmt.Sprintf("%d", attachment.UserID)
 		userid := r.Header.Get("id")
 		if role == "admin" || (role == "user" && idstring == userid) {
-			if App.IsTest {
-				App.DB.Unscoped().Delete(&attachment)
+			tx := s.App.DB.Begin()
+			if s.App.IsTest {
+				tx = tx.Unscoped()
+			}
+			// the rest of the group closes the gap of the deleted one
+			_, err := attachment.lock(tx)
+			if err == nil {
+				err = tx.Delete(&attachment).Error
+			}
+			if err == nil {
+				err = attachment.renumber(tx)
+			}
+			if err == nil {
+				err = s.publish(tx, "attachment.deleted", attachment.Public())
+			}
+			if err == nil {
+				err = tx.Commit().Error
 			} else {
-				App.DB.Delete(&attachment)
+				tx.Rollback()
+			}
+
+			if err != nil {
+				rsp.Errors.Add("ID", "Attachment not deleted")
+			} else {
+				s.notify()
 			}
 		} else {
 			rsp.Errors.Add("ID", "Only owner can delete attachment")
 		}
 	}
 
-	rsp.Data = &attachment
+	s.attachedFile(r, &attachment)
+
+	rsp.Data = attachment.Public()
 
 	w.Write(rsp.Make())
 }
@@ -0,0 +1,34 @@
+package files
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAttachDeleteRenumbers(t *testing.T) {
+	s := newTestService(t)
+
+	var group []Attachment
+	for i := 1; i <= 3; i++ {
+		a := Attachment{UserID: 1, Group: "gallery", OwnerType: "posts", OwnerID: 7, FileID: i, Index: i}
+		s.App.DB.Create(&a)
+		group = append(group, a)
+	}
+
+	r := httptest.NewRequest("DELETE", "/attachments", nil)
+	r.Header.Set("id", "1")
+	r.Header.Set("role", "user")
+	r = mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(group[0].ID)})
+
+	s.actionAttachDelete(httptest.NewRecorder(), r)
+
+	var left []Attachment
+	group[0].siblings(s.App.DB).Order("`index`").Find(&left)
+	if len(left) != 2 || left[0].ID != group[1].ID || left[0].Index != 1 ||
+		left[1].ID != group[2].ID || left[1].Index != 2 {
+		t.Errorf("Gap left after a delete: %+v", left)
+	}
+}
@@ -0,0 +1,134 @@
+package files
+
+import (
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// FileBlob counts the files sharing a deduplicated blob. An upload
+// counts itself before its record is saved, and the blob is stored and
+// removed while the row is locked, so it is never removed under an
+// upload about to use it.
+type FileBlob struct {
+	ID         uint   `gorm:"primary_key"`
+	Namespace  string `gorm:"type:varchar(100);not null;default:'';unique_index:idx_file_blob"`
+	Visibility string `gorm:"type:varchar(10);unique_index:idx_file_blob"`
+	Path       string `gorm:"unique_index:idx_file_blob"`
+	Refs       int
+}
+
+// row selects the row of the blob b.
+func (b FileBlob) row(db *gorm.DB) *gorm.DB {
+	return db.Model(&FileBlob{}).
+		Where("namespace = ? AND visibility = ? AND path = ?", b.Namespace, b.Visibility, b.Path)
+}
+
+// isBlob tells deduplicated storage keys from the keys of one file.
+func isBlob(key string) bool {
+	return strings.HasPrefix(key, "blobs/")
+}
+
+// holdBlob counts one more file using the blob of file and stores the
+// local file name as the blob, unless it is already there.
+func (s *Service) holdBlob(file File, name string) error {
+	storage := s.storageOf(file)
+
+	return s.lockBlob(file, 1, func(tx *gorm.DB, refs int) error {
+		if _, err := storage.Stat(file.Path); err == nil {
+			return nil
+		}
+
+		return putFile(storage, file.Path, name)
+	})
+}
+
+// releaseBlob counts one file less using the blob of file and
+// removes the blob and its variants with the last one.
+func (s *Service) releaseBlob(file File) error {
+	var removed error
+
+	err := s.lockBlob(file, -1, func(tx *gorm.DB, refs int) error {
+		if refs > 0 {
+			return nil
+		}
+
+		if err := s.blobOf(file).row(tx).Delete(&FileBlob{}).Error; err != nil {
+			return err
+		}
+
+		// still under the lock, an upload waiting for it stores the blob again
+		removed = s.deleteBlobs(file)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return removed
+}
+
+// blobOf is the blob row of the content of file.
+func (s *Service) blobOf(file File) FileBlob {
+	return FileBlob{Namespace: s.Opts.Namespace, Visibility: file.Visibility, Path: file.Path}
+}
+
+// lockBlob adds delta to the files using the blob of file and calls fn
+// with their new count, the row of the blob stays locked until fn returns.
+func (s *Service) lockBlob(file File, delta int, fn func(tx *gorm.DB, refs int) error) error {
+	blob := s.blobOf(file)
+
+	for {
+		tx := s.App.DB.Begin()
+
+		// the update locks the row until the end of the transaction
+		res := blob.row(tx).UpdateColumn("refs", gorm.Expr("refs + ?", delta))
+		if res.Error != nil {
+			tx.Rollback()
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			tx.Rollback()
+
+			if err := s.countBlob(blob, delta < 0); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var refs int
+		err := blob.row(tx).Select("refs").Row().Scan(&refs)
+		if err == nil {
+			err = fn(tx, refs)
+		}
+		if err == nil {
+			err = tx.Commit().Error
+		} else {
+			tx.Rollback()
+		}
+
+		return err
+	}
+}
+
+// countBlob creates the missing row of a blob, stored before the blobs
+// were counted or removed with its last file, from the files using it.
+// The file being released is no longer among them.
+func (s *Service) countBlob(blob FileBlob, releasing bool) error {
+	s.scoped(s.App.DB).Model(&File{}).
+		Where("path = ? AND visibility = ?", blob.Path, blob.Visibility).
+		Count(&blob.Refs)
+	if releasing {
+		blob.Refs++
+	}
+
+	err := s.App.DB.Create(&blob).Error
+	if err != nil && !blob.row(s.App.DB).First(&FileBlob{}).RecordNotFound() {
+		// created meanwhile by another upload
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,89 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+func TestBlobHeldByUpload(t *testing.T) {
+	s := newTestService(t, WithDedup())
+	ctx := context.Background()
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := s.Save(ctx, 1, "a.png", bytes.NewReader(pic), SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b is stored but not saved yet when the last saved file goes
+	b, err := s.store(File{UserID: 2, Visibility: VisibilityPublic}, "", "b.png", bytes.NewReader(pic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Path != a.Path {
+		t.Fatalf("Same content must share the blob: %s %s", a.Path, b.Path)
+	}
+
+	if err := s.Delete(ctx, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Opts.Storage.Stat(b.Path); err != nil {
+		t.Fatalf("Blob removed under a pending upload: %v", err)
+	}
+
+	if b, err = s.insert(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Opts.Storage.Stat(b.Path); err == nil {
+		t.Error("Blob kept after its last file was deleted")
+	}
+
+	var rows int
+	s.App.DB.Model(&FileBlob{}).Count(&rows)
+	if rows != 0 {
+		t.Errorf("Row of a removed blob kept: %d", rows)
+	}
+}
+
+func TestBlobCountedFromFiles(t *testing.T) {
+	s := newTestService(t, WithDedup())
+	ctx := context.Background()
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved []File
+	for _, name := range []string{"a.png", "b.png"} {
+		file, err := s.Save(ctx, 1, name, bytes.NewReader(pic), SaveOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved = append(saved, file)
+	}
+
+	// blobs stored before they were counted
+	s.App.DB.Delete(&FileBlob{})
+
+	if err := s.Delete(ctx, saved[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Opts.Storage.Stat(saved[1].Path); err != nil {
+		t.Fatalf("Blob removed while still used: %v", err)
+	}
+
+	if err := s.Delete(ctx, saved[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Opts.Storage.Stat(saved[1].Path); err == nil {
+		t.Error("Blob kept after its last file was deleted")
+	}
+}
@@ -0,0 +1,62 @@
+package files
+
+import (
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// actionDownload streams the file content from the storage,
+// with support of Range and conditional requests.
+func (s *Service) actionDownload(w http.ResponseWriter, r *http.Request) {
+	var file File
+
+	vars := mux.Vars(r)
+	s.scoped(s.App.DB).First(&file, vars["id"])
+
+	if file.ID == 0 || !(canRead(r, file) || s.validSignature(r, file)) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	s.serveFile(w, r, file)
+}
+
+func (s *Service) serveFile(w http.ResponseWriter, r *http.Request, file File) {
+	key, etag := file.Path, file.Hash
+	if v, ok := file.Variants[r.FormValue("variant")]; ok {
+		key, etag = v.Path, file.Hash+"-"+r.FormValue("variant")
+	}
+
+	obj, err := s.storageOf(file).Get(key)
+	if err != nil {
+		http.Error(w, "File content not found", http.StatusNotFound)
+		return
+	}
+	defer obj.Close()
+
+	name := file.Name + file.Ext
+
+	disposition := "attachment"
+	if r.FormValue("inline") != "" {
+		disposition = "inline"
+	}
+
+	// the type sniffed at upload, never guessed again from the name or
+	// the content, variants keep the format of the original
+	contentType := file.Mime
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition",
+		mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	if file.Hash != "" {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+
+	http.ServeContent(w, r, name, file.UpdatedAt, obj)
+}
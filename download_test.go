@@ -0,0 +1,46 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDownloadType(t *testing.T) {
+	s := newTestService(t)
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := s.Save(context.Background(), 1, "a.png", bytes.NewReader(pic), SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the name no longer decides the type
+	s.App.DB.Model(&file).Update("ext", ".html")
+
+	r := httptest.NewRequest("GET", "/files/download", nil)
+	r.Header.Set("id", "1")
+	r.Header.Set("role", "user")
+	r = mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(file.ID)})
+
+	w := httptest.NewRecorder()
+	s.actionDownload(w, r)
+
+	if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), pic) {
+		t.Fatalf("Download failed: %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Wrong type: %s", ct)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("Type may be sniffed")
+	}
+}
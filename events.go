@@ -0,0 +1,96 @@
+package files
+
+import (
+	"context"
+	"log"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Events of the file lifecycle. The before ones run ahead of the change
+// and any hook returning an error rejects it, the others run after it.
+const (
+	EventBeforeUpload  = "before_upload"
+	EventUploaded      = "uploaded"
+	EventBeforeReplace = "before_replace"
+	EventReplaced      = "replaced"
+	EventBeforeDelete  = "before_delete"
+	EventDeleted       = "deleted"
+)
+
+// Hook is called with the file of an event. On upload and replace the
+// content is already stored, but the record is not saved yet for
+// the before events.
+type Hook func(ctx context.Context, file File) error
+
+// HookError is a change rejected by a before hook.
+type HookError struct {
+	Event string
+	Err   error
+}
+
+func (e *HookError) Error() string { return e.Err.Error() }
+
+func (e *HookError) Unwrap() error { return e.Err }
+
+// On registers the hook for the event on the Default service.
+func On(event string, h Hook) { Default.On(event, h) }
+
+func OnBeforeUpload(h Hook)  { On(EventBeforeUpload, h) }
+func OnUploaded(h Hook)      { On(EventUploaded, h) }
+func OnBeforeReplace(h Hook) { On(EventBeforeReplace, h) }
+func OnReplaced(h Hook)      { On(EventReplaced, h) }
+func OnBeforeDelete(h Hook)  { On(EventBeforeDelete, h) }
+func OnDeleted(h Hook)       { On(EventDeleted, h) }
+
+// On registers the hook for the event, hooks run in the order
+// they were registered.
+func (s *Service) On(event string, h Hook) {
+	s.hooksMu.Lock()
+	defer s.hooksMu.Unlock()
+
+	if s.hooks == nil {
+		s.hooks = map[string][]Hook{}
+	}
+	s.hooks[event] = append(s.hooks[event], h)
+}
+
+// veto runs the hooks of a before event and returns
+// the first rejection as a *HookError.
+func (s *Service) veto(ctx context.Context, event string, file File) error {
+	s.hooksMu.RLock()
+	list := s.hooks[event]
+	s.hooksMu.RUnlock()
+
+	for _, h := range list {
+		if err := h(ctx, file); err != nil {
+			return &HookError{Event: event, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// publishFile queues the "file.<event>" webhooks in the transaction
+// db of the change.
+func (s *Service) publishFile(db *gorm.DB, event string, file File) error {
+	s.withURLs(&file)
+
+	return s.publish(db, "file."+event, file.Public())
+}
+
+// emit runs the hooks of an event that already happened, their errors
+// can only be logged, and wakes a worker to send its webhooks.
+func (s *Service) emit(ctx context.Context, event string, file File) {
+	s.notify()
+
+	s.hooksMu.RLock()
+	list := s.hooks[event]
+	s.hooksMu.RUnlock()
+
+	for _, h := range list {
+		if err := h(ctx, file); err != nil {
+			log.Printf("files: %s hook: %v", event, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package files
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// NewTestService gives the files_test tests the service of newTestService.
+var NewTestService = newTestService
+
+// testDB opens a sqlite db in a temp dir, closed with the test.
+func testDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "files.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// newTestService sets up a service without workers on its own db.
+func newTestService(t *testing.T, opts ...Option) *Service {
+	return newTestServiceOn(t, testDB(t), opts...)
+}
+
+// newTestServiceOn sets up a service without workers on db, with its own
+// temp storages and router.
+func newTestServiceOn(t *testing.T, db *gorm.DB, opts ...Option) *Service {
+	dir := t.TempDir()
+
+	opts = append([]Option{
+		WithWorkers(-1),
+		WithTempDir(dir),
+		WithStorage(NewLocalStorage(filepath.Join(dir, "public"), "/uploads")),
+		WithPrivateStorage(NewLocalStorage(filepath.Join(dir, "private"), "")),
+	}, opts...)
+
+	return NewService(core.App{DB: db, R: mux.NewRouter(), IsTest: true}, opts...)
+}
@@ -2,13 +2,15 @@ package files
 
 import (
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -19,66 +21,222 @@ import (
 	"github.com/jinzhu/gorm"
 )
 
+// App is the app of the Default service.
 var App core.App
 
 type Files []File
 
 type File struct {
 	gorm.Model
-	UserID int    `json:"userID"`
-	Name   string `json:"name"`
-	Path   string `json:"path"`
-	Src    string `json:"src"`
-	Ext    string `json:"ext" gorm:"type:varchar(10)"`
-	Preset string `json:"preset"`
-	Size   int64  `json:"size"`
-	Status int    `json:"status"`
-	Type   int    `json:"type"`
-	Hash   string `json:"hash"`
+	UserID   int      `json:"userID"`
+	Name     string   `json:"name"`
+	Path     string   `json:"path"`
+	Src      string   `json:"src"`
+	Ext      string   `json:"ext" gorm:"type:varchar(10)"`
+	Preset   string   `json:"preset"`
+	Size     int64    `json:"size"`
+	Status   int      `json:"status"`
+	Type     int      `json:"type"`
+	Hash     string   `json:"hash"`
+	Variants Variants `json:"variants" gorm:"type:text"`
+	Meta     Metadata `json:"meta" gorm:"type:text"`
+	// Exif is never sent to clients, see ExifData
+	Exif ExifData `json:"-" gorm:"type:text"`
+	// Mime is sniffed from the content, not taken from the client
+	Mime string `json:"mime" gorm:"type:varchar(100)"`
+	// Visibility is VisibilityPublic or VisibilityPrivate, private files
+	// are kept out of the web root and served by the download endpoint.
+	Visibility string `json:"visibility" gorm:"type:varchar(10);default:'public'"`
+	// Failure is ErrProcessing with StatusFailed, empty otherwise
+	Failure   string `json:"failure" gorm:"type:text"`
+	Namespace string `json:"-" gorm:"type:varchar(100);not null;default:'';index"`
 }
 
-func Configure(a core.App) {
+// Configure sets up the Default service with the app, the options are
+// applied over the package Opts. App and Opts then mirror the Default
+// service for code written before Service.
+func Configure(a core.App, opts ...Option) {
+	Default.Opts = Opts
+	Default.init(a, opts...)
+
 	App = a
+	Opts = Default.Opts
+}
+
+// init applies the options, migrates the tables, registers
+// the routes on the app router and starts the workers.
+func (s *Service) init(a core.App, opts ...Option) {
+	s.App = a
+
+	for _, opt := range opts {
+		opt(&s.Opts)
+	}
+
+	if s.Opts.Storage == nil {
+		dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.Opts.Storage = NewLocalStorage(
+			dir+"/"+s.App.Config.WebRootPath+"/"+s.App.Config.UploadsPath,
+			"/"+s.App.Config.UploadsPath)
+	}
 
-	App.DB.AutoMigrate(&File{}, &Attachment{})
+	if s.Opts.PrivateStorage == nil {
+		dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		s.Opts.PrivateStorage = NewLocalStorage(
+			dir+"/private/"+s.App.Config.UploadsPath, "")
+	}
+
+	if s.Opts.Workers == 0 {
+		s.Opts.Workers = 1
+	}
+	if s.Opts.PollInterval == 0 {
+		s.Opts.PollInterval = 5 * time.Second
+	}
+	if s.Opts.JobTimeout == 0 {
+		s.Opts.JobTimeout = 10 * time.Minute
+	}
+	if s.Opts.MaxAttempts == 0 {
+		s.Opts.MaxAttempts = 5
+	}
+	if s.Opts.RetryDelay == 0 {
+		s.Opts.RetryDelay = 30 * time.Second
+	}
+
+	if s.Opts.WebhookAttempts == 0 {
+		s.Opts.WebhookAttempts = 8
+	}
+	if s.Opts.WebhookRetryDelay == 0 {
+		s.Opts.WebhookRetryDelay = time.Minute
+	}
+	if s.Opts.UploadExpiry == 0 {
+		s.Opts.UploadExpiry = 24 * time.Hour
+	}
+	if s.Opts.MaxPageSize == 0 {
+		s.Opts.MaxPageSize = 100
+	}
+	if s.Opts.MaxTransformSize == 0 {
+		s.Opts.MaxTransformSize = 2048
+	}
+	if s.Opts.MaxImagePixels == 0 {
+		s.Opts.MaxImagePixels = 50000000
+	}
+
+	if len(s.Opts.SigningKey) == 0 {
+		// links signed with a random key die with the process
+		s.Opts.SigningKey = make([]byte, 32)
+		if _, err := rand.Read(s.Opts.SigningKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	s.App.DB.AutoMigrate(&File{}, &Attachment{}, &FileUpload{}, &FileUploadPart{}, &UserQuota{}, &FileJob{}, &Derivative{}, &WebhookDelivery{}, &FileBlob{})
+
+	// derivatives were unique by path in all namespaces before
+	derivatives := s.App.DB.NewScope(&Derivative{}).TableName()
+	if s.App.DB.Dialect().HasIndex(derivatives, "uix_derivatives_path") {
+		s.App.DB.Model(&Derivative{}).RemoveIndex("uix_derivatives_path")
+	}
+
+	if s.wake == nil {
+		s.wake = make(chan struct{}, 1)
+	}
+	s.startWorkers()
 
 	//public actions
 
 	//protect CRUD actions with files info
-	App.R.HandleFunc("/files", actionGetAll).Methods("GET")
-	App.R.HandleFunc("/files/{id}", actionGetOne).Methods("GET")
-	App.R.HandleFunc(
+	s.App.R.HandleFunc(
+		"/files/usage",
+		s.App.Protect(
+			s.actionUsage,
+			[]string{"admin", "user"})).Methods("GET")
+	s.App.R.HandleFunc(
+		"/files/usages",
+		s.App.Protect(
+			s.actionUsages,
+			[]string{"admin"})).Methods("GET")
+	s.App.R.HandleFunc(
+		"/files/quotas/{userid}",
+		s.App.Protect(
+			s.actionSetQuota,
+			[]string{"admin"})).Methods("PUT")
+
+	s.App.R.HandleFunc("/files", s.withOptionalAuth(s.actionGetAll)).Methods("GET")
+	s.App.R.HandleFunc("/files/{id}", s.withOptionalAuth(s.actionGetOne)).Methods("GET")
+	s.App.R.HandleFunc("/files/{id}/content", s.withOptionalAuth(s.actionDownload)).Methods("GET", "HEAD")
+	s.App.R.HandleFunc("/files/{id}/image", s.withOptionalAuth(s.actionImage)).Methods("GET", "HEAD")
+	s.App.R.HandleFunc(
+		"/files/{id}/image",
+		s.App.Protect(
+			s.actionSignImage,
+			[]string{"admin", "user"})).Methods("POST")
+	s.App.R.HandleFunc(
+		"/files/{id}/share",
+		s.App.Protect(
+			s.actionShare,
+			[]string{"admin", "user"})).Methods("POST")
+	s.App.R.HandleFunc(
 		"/files",
-		App.Protect(
-			actionUpload,
+		s.App.Protect(
+			s.actionUpload,
 			[]string{"admin", "user"})).Methods("POST")
-	App.R.HandleFunc(
+	s.App.R.HandleFunc(
 		"/files/{id}",
-		App.Protect(
-			actionReUpload,
+		s.App.Protect(
+			s.actionReUpload,
 			[]string{"admin", "user"})).Methods("PATCH")
-	App.R.HandleFunc(
+	s.App.R.HandleFunc(
 		"/files/{id}",
-		App.Protect(
-			actionDelete,
+		s.App.Protect(
+			s.actionDelete,
 			[]string{"admin", "user"})).Methods("DELETE")
 
-	App.R.HandleFunc("/attachments", actionAttchGetAll).Methods("GET")
-	App.R.HandleFunc("/attachments/{id}", actionAttachGetOne).Methods("GET")
-	App.R.HandleFunc(
+	//resumable uploads (tus protocol)
+	s.App.R.HandleFunc("/files/uploads", s.actionTusOptions).Methods("OPTIONS")
+	s.App.R.HandleFunc(
+		"/files/uploads",
+		s.App.Protect(
+			s.actionTusCreate,
+			[]string{"admin", "user"})).Methods("POST")
+	s.App.R.HandleFunc(
+		"/files/uploads/{id}",
+		s.App.Protect(
+			s.actionTusHead,
+			[]string{"admin", "user"})).Methods("HEAD")
+	s.App.R.HandleFunc(
+		"/files/uploads/{id}",
+		s.App.Protect(
+			s.actionTusPatch,
+			[]string{"admin", "user"})).Methods("PATCH")
+
+	s.App.R.HandleFunc("/attachments", s.withOptionalAuth(s.actionAttchGetAll)).Methods("GET")
+	s.App.R.HandleFunc("/attachments/{id}", s.withOptionalAuth(s.actionAttachGetOne)).Methods("GET")
+	s.App.R.HandleFunc(
 		"/attachments",
-		App.Protect(
-			actionAttachCreate,
+		s.App.Protect(
+			s.actionAttachCreate,
 			[]string{"admin", "user"})).Methods("POST")
-	App.R.HandleFunc(
+	s.App.R.HandleFunc(
+		"/attachments/order",
+		s.App.Protect(
+			s.actionAttachOrder,
+			[]string{"admin", "user"})).Methods("PUT")
+	s.App.R.HandleFunc(
 		"/attachments/{id}",
-		App.Protect(
-			actionAttachUpdate,
+		s.App.Protect(
+			s.actionAttachUpdate,
 			[]string{"admin", "user"})).Methods("PATCH")
-	App.R.HandleFunc(
+	s.App.R.HandleFunc(
 		"/attachments/{id}",
-		App.Protect(
-			actionAttachDelete,
+		s.App.Protect(
+			s.actionAttachDelete,
 			[]string{"admin", "user"})).Methods("DELETE")
 }
 
@@ -91,87 +249,271 @@ func CreateDirIfNotExist(dir string) {
 	}
 }
 
-func upload(r *http.Request) (File, error) {
-	// Parse our multipart form, 10 << 20 specifies a maximum
-	// upload of 10 MB files.
-	r.ParseMultipartForm(10 << 20)
-	// FormFile returns the first file for the given key `myFile`
-	// it also returns the FileHeader so we can get the Filename,
-	// the Header and the size of the file
-	file, handler, err := r.FormFile("file")
+var (
+	ErrNoFile       = errors.New("Error Retrieving the File")
+	ErrFileTooLarge = errors.New("File is too large")
+)
+
+// upload streams the "file" part of a multipart request to the storage,
+// the body is never fully buffered in memory. base holds the owner, the
+// default visibility and the id of the replaced file if any. The visibility
+// is taken from the "visibility" field sent before the file or the query.
+func (s *Service) upload(r *http.Request, base File) (File, error) {
+	mr, err := r.MultipartReader()
 	if err != nil {
-		return File{}, errors.New("Error Retrieving the File")
+		return File{}, ErrNoFile
+	}
+
+	visibility := base.Visibility
+	if v := r.URL.Query().Get("visibility"); v != "" {
+		visibility = v
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return File{}, ErrNoFile
+		}
+
+		if part.FormName() == "visibility" {
+			v, _ := ioutil.ReadAll(io.LimitReader(part, 10))
+			visibility = string(v)
+		}
+
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		defer part.Close()
+
+		if visibility != VisibilityPublic && visibility != VisibilityPrivate {
+			return File{}, ErrVisibility
+		}
+
+		base.Visibility = visibility
+
+		return s.store(base, r.Header.Get("role"), part.FileName(), part)
 	}
-	defer file.Close()
-	filename := strings.TrimSuffix(handler.Filename, path.Ext(handler.Filename))
-	fileext := path.Ext(handler.Filename)
+}
 
-	fileBytes, err := ioutil.ReadAll(file)
+// store writes the content of src to the storage and returns
+// the File model describing it, the model is not saved to the db.
+// The content is hashed while it is copied to a temp file and moved
+// into the storage only when it is complete. The owner, visibility and
+// id of a replaced file are taken from filemodel, the upload policy and
+// quota from role.
+func (s *Service) store(filemodel File, role, name string, src io.Reader) (File, error) {
+	filename, fileext := splitName(name)
+
+	policy := s.policyFor(role)
+	if err := policy.CheckExt(fileext); err != nil {
+		return File{}, err
+	}
+
+	remaining, err := s.quotaLeft(filemodel.UserID, role, filemodel.ID)
 	if err != nil {
 		return File{}, err
 	}
 
-	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	tmp, err := ioutil.TempFile(s.Opts.TempDir, "upload-")
 	if err != nil {
-		log.Fatal(err)
+		return File{}, err
 	}
-	fmt.Println(dir)
+	defer os.Remove(tmp.Name())
 
-	tm := time.Now()
-	d := 24 * time.Hour
+	// stop reading right after the first byte over a limit
+	limit := int64(-1)
+	if s.Opts.MaxUploadSize > 0 {
+		limit = s.Opts.MaxUploadSize
+	}
+	if remaining >= 0 && (limit < 0 || remaining < limit) {
+		limit = remaining
+	}
+	if limit >= 0 {
+		src = io.LimitReader(src, limit+1)
+	}
 
-	userpersonaldir := fmt.Sprintf("%x", md5.Sum([]byte(r.Header.Get("id"))))
-	userdatedir := fmt.Sprintf("%d", tm.Truncate(d).Unix())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), src)
+	tmp.Close()
 
-	userdir := dir + "/" + App.Config.WebRootPath + "/" + App.Config.UploadsPath
-	userdir += "/" + userpersonaldir
-	userdir += "/" + userdatedir
+	if err != nil {
+		return File{}, err
+	}
 
-	CreateDirIfNotExist(userdir)
+	if s.Opts.MaxUploadSize > 0 && size > s.Opts.MaxUploadSize {
+		return File{}, ErrFileTooLarge
+	}
 
-	err = ioutil.WriteFile(userdir+"/"+filename+fileext, fileBytes, 0644)
+	if remaining >= 0 && size > remaining {
+		return File{}, ErrQuotaExceeded
+	}
 
+	mimeType, err := sniff(tmp.Name(), fileext)
 	if err != nil {
 		return File{}, err
 	}
 
-	userid, _ := strconv.Atoi(r.Header.Get("id"))
+	if err := policy.Check(mimeType, fileext); err != nil {
+		return File{}, err
+	}
+
+	filemodel.Hash = fmt.Sprintf("%x", hash.Sum(nil))
+
+	if s.Opts.StripMetadata {
+		if s.Opts.KeepMetadata {
+			_, filemodel.Exif, _ = readMetadata(tmp.Name())
+		}
+
+		changed, err := sanitizeImage(tmp.Name(), mimeType, s.Opts.MaxImagePixels)
+		if err != nil {
+			return File{}, err
+		}
 
-	return File{
-		UserID: userid,
-		Name:   filename,
-		Path:   userdir + "/" + filename + fileext,
-		Src:    "/" + App.Config.UploadsPath + "/" + userpersonaldir + "/" + userdatedir + "/" + filename + fileext,
-		Ext:    fileext,
-		Preset: "notset",
-		Size:   handler.Size,
-		Status: 0,
-		Type:   0,
-		Hash:   fmt.Sprintf("%x", md5.Sum(fileBytes)),
-	}, nil
+		if changed {
+			filemodel.Hash, size, err = hashFile(tmp.Name())
+			if err != nil {
+				return File{}, err
+			}
+		}
+	}
+
+	if filemodel.Visibility == "" {
+		filemodel.Visibility = VisibilityPublic
+	}
+
+	filemodel.Name = filename
+	filemodel.Ext = fileext
+	filemodel.Size = size
+	filemodel.Mime = mimeType
+	filemodel.Type = classify(mimeType)
+
+	storage := s.storageOf(filemodel)
+
+	if s.Opts.Dedup {
+		filemodel.Path = blobKey(filemodel.Hash, fileext)
+
+		if err := s.holdBlob(filemodel, tmp.Name()); err != nil {
+			return File{}, err
+		}
+
+		// the blob is already used by another file, share its variants
+		var same File
+		s.scoped(s.App.DB).Where("path = ? AND visibility = ?", filemodel.Path, filemodel.Visibility).First(&same)
+		if same.ID != 0 {
+			filemodel.Src = same.Src
+			filemodel.Preset = same.Preset
+			filemodel.Variants = same.Variants
+			if same.Status == StatusReady {
+				filemodel.Status = StatusReady
+				// only the size, the exif of the other upload is not ours
+				filemodel.Meta.Width = same.Meta.Width
+				filemodel.Meta.Height = same.Meta.Height
+			}
+			return filemodel, nil
+		}
+	} else {
+		tm := time.Now()
+		d := 24 * time.Hour
+
+		userpersonaldir := fmt.Sprintf("%x", md5.Sum([]byte(strconv.Itoa(filemodel.UserID))))
+		userdatedir := fmt.Sprintf("%d", tm.Truncate(d).Unix())
+
+		unique, err := storageName(filename, fileext)
+		if err != nil {
+			return File{}, err
+		}
+
+		filemodel.Path = userpersonaldir + "/" + userdatedir + "/" + unique
+
+		if err := putFile(storage, filemodel.Path, tmp.Name()); err != nil {
+			return File{}, err
+		}
+	}
+
+	filemodel.Src = savedURL(storage, filemodel.Path)
+	filemodel.Preset = Variants(nil).presetNames(s.Opts.Presets)
+
+	return filemodel, nil
+}
+
+// blobKey is the storage key of deduplicated content,
+// files with the same content share it.
+func blobKey(hash, ext string) string {
+	return "blobs/" + hash[:2] + "/" + hash + strings.ToLower(ext)
+}
+
+// removeBlobs deletes the file and all its variants from the storage,
+// shared blobs are kept until the last file using them is gone.
+func (s *Service) removeBlobs(file File) error {
+	s.removeDerivatives(file)
+
+	if isBlob(file.Path) {
+		return s.releaseBlob(file)
+	}
+
+	return s.deleteBlobs(file)
+}
+
+// deleteBlobs deletes the blob and the variants of file from the storage.
+func (s *Service) deleteBlobs(file File) error {
+	storage := s.storageOf(file)
+
+	for _, v := range file.Variants {
+		storage.Delete(v.Path)
+	}
+
+	if file.Path == "" {
+		return nil
+	}
+
+	return storage.Delete(file.Path)
 }
 
-func actionGetAll(w http.ResponseWriter, r *http.Request) {
+// putFile moves a complete local file into the storage.
+func putFile(storage Storage, key, name string) error {
+	if fp, ok := storage.(FilePutter); ok {
+		return fp.PutFile(key, name)
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return storage.Put(key, f)
+}
+
+// countingReader counts bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (s *Service) actionGetAll(w http.ResponseWriter, r *http.Request) {
 	var (
 		files  Files
 		rsp    = core.Response{Data: &files, Req: r}
 		all    = r.FormValue("all")
 		id     = r.FormValue("id")
 		name   = r.FormValue("name")
-		path   = r.FormValue("path")
 		ext    = r.FormValue("ext")
 		preset = r.FormValue("preset")
-		sort   = r.FormValue("sort")
-		limit  = r.FormValue("limit")
-		offset = r.FormValue("offset")
-		db     = App.DB
+		ftype  = r.FormValue("type")
+		db     = visibleFiles(s.scoped(s.App.DB), r)
 	)
 
 	if all != "" {
-		db = db.Where("id LIKE ?", "%"+all+"%")
-		db = db.Or("name LIKE ?", "%"+all+"%")
-		db = db.Or("path LIKE ?", "%"+all+"%")
-		db = db.Or("ext LIKE ?", "%"+all+"%")
+		// grouped, an Or next to the visibility scope would reveal private files
+		db = db.Where("id LIKE ? OR name LIKE ? OR ext LIKE ?",
+			"%"+all+"%", "%"+all+"%", "%"+all+"%")
 	}
 
 	if id != "" {
@@ -182,10 +524,6 @@ func actionGetAll(w http.ResponseWriter, r *http.Request) {
 		db = db.Where("name LIKE ?", "%"+name+"%")
 	}
 
-	if path != "" {
-		db = db.Where("path LIKE ?", "%"+path+"%")
-	}
-
 	if ext != "" {
 		db = db.Where("ext LIKE ?", "%"+ext+"%")
 	}
@@ -194,30 +532,31 @@ func actionGetAll(w http.ResponseWriter, r *http.Request) {
 		db = db.Where("preset = ?", preset)
 	}
 
-	if sort != "" {
-		db = db.Order(sort)
+	if ftype != "" {
+		db = db.Where("type IN (?)", parseTypes(ftype))
 	}
 
-	if limit != "" {
-		db = db.Limit(limit)
+	list, err := fileList.query(db, r, s.Opts.MaxPageSize)
+	if err != nil {
+		rsp.Errors.Add("query", err.Error())
+	} else {
+		list.find(&files)
 	}
 
-	if offset != "" {
-		db = db.Offset(offset)
+	for i := range files {
+		s.withURLs(&files[i])
 	}
 
-	db.Find(&files)
+	rsp.Data = files.Public()
 
-	rsp.Data = &files
-
-	w.Write(rsp.Make())
+	writeList(w, &rsp, list)
 }
 
-func actionGetOne(w http.ResponseWriter, r *http.Request) {
+func (s *Service) actionGetOne(w http.ResponseWriter, r *http.Request) {
 	var (
 		file File
 		rsp  = core.Response{Data: &file, Req: r}
-		db   = App.DB
+		db   = visibleFiles(s.scoped(s.App.DB), r)
 	)
 
 	vars := mux.Vars(r)
@@ -226,39 +565,47 @@ func actionGetOne(w http.ResponseWriter, r *http.Request) {
 
 	if file.ID == 0 {
 		rsp.Errors.Add("ID", "File not found")
-	} else {
-		rsp.Data = &file
 	}
 
+	s.withURLs(&file)
+
+	rsp.Data = file.Public()
+
 	w.Write(rsp.Make())
 }
 
-func actionUpload(w http.ResponseWriter, r *http.Request) {
+func (s *Service) actionUpload(w http.ResponseWriter, r *http.Request) {
 	var (
 		filemodel File
 		rsp       = core.Response{Data: &filemodel, Req: r}
 	)
 
-	filemodel, err := upload(r)
+	userid, _ := strconv.Atoi(r.Header.Get("id"))
+
+	filemodel, err := s.upload(r, File{UserID: userid, Visibility: VisibilityPublic})
+	if err == nil {
+		filemodel, err = s.insert(r.Context(), filemodel)
+	}
+
 	if err != nil {
 		rsp.Errors.Add("file", err.Error())
-	} else {
-		App.DB.Create(&filemodel)
-
-		rsp.Data = &filemodel
 	}
 
+	s.withURLs(&filemodel)
+
+	rsp.Data = filemodel.Public()
+
 	w.Write(rsp.Make())
 }
 
-func actionReUpload(w http.ResponseWriter, r *http.Request) {
+func (s *Service) actionReUpload(w http.ResponseWriter, r *http.Request) {
 	var (
 		filemodel File
 		rsp       = core.Response{Data: &filemodel, Req: r}
 	)
 
 	vars := mux.Vars(r)
-	App.DB.First(&filemodel, vars["id"])
+	s.scoped(s.App.DB).First(&filemodel, vars["id"])
 
 	if filemodel.ID == 0 {
 		rsp.Errors.Add("ID", "File not found")
@@ -267,32 +614,85 @@ func actionReUpload(w http.ResponseWriter, r *http.Request) {
 		idstring := fmt.Sprintf("%d", filemodel.UserID)
 		userid := r.Header.Get("id")
 		if role == "admin" || (role == "user" && idstring == userid) {
-			data, err := upload(r)
+			data, err := s.upload(r, File{
+				Model:      gorm.Model{ID: filemodel.ID},
+				UserID:     filemodel.UserID,
+				Visibility: filemodel.Visibility,
+			})
+			if err == nil {
+				if err = s.veto(r.Context(), EventBeforeReplace, data); err != nil {
+					s.removeBlobs(data)
+				}
+			}
+
 			if err != nil {
 				rsp.Errors.Add("file", err.Error())
 			} else {
-				err := os.Remove(filemodel.Path)
+				old := filemodel
+
+				// a map, so the zero type, status or failure of the new
+				// content replace the old ones too
+				tx := s.App.DB.Begin()
+				err = tx.Model(&filemodel).Updates(map[string]interface{}{
+					"name":       data.Name,
+					"path":       data.Path,
+					"src":        data.Src,
+					"ext":        data.Ext,
+					"preset":     data.Preset,
+					"size":       data.Size,
+					"status":     data.Status,
+					"type":       data.Type,
+					"hash":       data.Hash,
+					"variants":   data.Variants,
+					"meta":       data.Meta,
+					"exif":       data.Exif,
+					"mime":       data.Mime,
+					"visibility": data.Visibility,
+					"failure":    "",
+				}).Error
+				if err == nil {
+					err = s.publishFile(tx, EventReplaced, filemodel)
+				}
+				if err == nil {
+					err = tx.Commit().Error
+				} else {
+					tx.Rollback()
+				}
+
+				// the record points to the content it keeps, the other goes
 				if err != nil {
+					filemodel = old
+					s.removeBlobs(data)
 					rsp.Errors.Add("file", err.Error())
+				} else {
+					// a shared blob of the same content is only counted once less
+					if err := s.removeBlobs(old); err != nil {
+						rsp.Errors.Add("file", err.Error())
+					}
+					s.enqueue(&filemodel)
+					s.emit(r.Context(), EventReplaced, filemodel)
 				}
-				App.DB.Model(&filemodel).Updates(data)
 			}
 		} else {
 			rsp.Errors.Add("file", "Only owner can change element")
 		}
 	}
 
+	s.withURLs(&filemodel)
+
+	rsp.Data = filemodel.Public()
+
 	w.Write(rsp.Make())
 }
 
-func actionDelete(w http.ResponseWriter, r *http.Request) {
+func (s *Service) actionDelete(w http.ResponseWriter, r *http.Request) {
 	var (
 		file File
 		rsp  = core.Response{Data: &file, Req: r}
 	)
 
 	vars := mux.Vars(r)
-	App.DB.First(&file, vars["id"])
+	s.scoped(s.App.DB).First(&file, vars["id"])
 
 	if file.ID == 0 {
 		rsp.Errors.Add("ID", "File not found")
@@ -301,13 +701,7 @@ func actionDelete(w http.ResponseWriter, r *http.Request) {
 		idstring := fmt.Sprintf("%d", file.UserID)
 		userid := r.Header.Get("id")
 		if role == "admin" || (role == "user" && idstring == userid) {
-			if App.IsTest {
-				App.DB.Unscoped().Delete(&file)
-			} else {
-				App.DB.Delete(&file)
-			}
-			err := os.Remove(file.Path)
-			if err != nil {
+			if err := s.remove(r.Context(), file); err != nil {
 				rsp.Errors.Add("file", err.Error())
 			}
 		} else {
@@ -315,7 +709,7 @@ func actionDelete(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	rsp.Data = &file
+	rsp.Data = file.Public()
 
 	w.Write(rsp.Make())
 }
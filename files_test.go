@@ -2,17 +2,24 @@ package files_test
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"image"
+	_ "image/jpeg"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-rest-framework/core"
 	"github.com/go-rest-framework/files"
@@ -24,6 +31,7 @@ var OneNewID uint
 var OneANewID uint
 var AdminToken string
 var OneGroup string
+var OneOwnerType string
 var OneTitle string
 var NewOneTitle string
 var NewAOneTitle string
@@ -247,12 +255,41 @@ func TestUpload(t *testing.T) {
 	TestFileUserID = u.Data.UserID
 }
 
+func TestUploadDenied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := map[string]string{
+		"shell.php": "<?php echo 'hi'; ?>",
+		"fake.png":  "<html><script>alert(1)</script></html>",
+		"page.html": "<html></html>",
+	}
+
+	for name, content := range cases {
+		p := dir + "/" + name
+		ioutil.WriteFile(p, []byte(content), 0644)
+
+		u := readFileBody(doUpload(Murl, "POST", p), t)
+
+		if len(u.Errors) == 0 {
+			t.Errorf("Upload of %s must be rejected", name)
+			deleteFile(t, u.Data.ID)
+		}
+	}
+}
+
 func TestAttachmentCreate(t *testing.T) {
 	url := AMurl
 	OneGroup = fake.Word()
 	OneTitle = fake.Title()
+	OneOwnerType = fake.Word() + "s"
 	el := &files.Attachment{
 		Group:       OneGroup,
+		OwnerType:   OneOwnerType,
+		OwnerID:     1,
 		FileID:      int(TestFileID),
 		Title:       OneTitle,
 		Description: fake.Paragraphs(),
@@ -311,9 +348,206 @@ func TestGetOne(t *testing.T) {
 		t.Fatal(u.Errors)
 	}
 
+	if u.Data.Path != "" {
+		t.Errorf("Storage path is exposed: %s", u.Data.Path)
+	}
+
+	return
+}
+
+func TestProcessing(t *testing.T) {
+	url := fmt.Sprintf("%s%s%d", Murl, "/", TestFileID)
+
+	for i := 0; i < 20; i++ {
+		u := readFileBody(doRequest(url, "GET", "", " "), t)
+
+		if len(u.Errors) != 0 {
+			t.Fatal(u.Errors)
+		}
+
+		switch u.Data.Status {
+		case files.StatusReady:
+			if u.Data.Meta.Width == 0 || u.Data.Meta.Height == 0 {
+				t.Errorf("No image size in metadata: %+v", u.Data.Meta)
+			}
+			return
+		case files.StatusFailed:
+			t.Fatalf("Processing failed: %s", u.Data.Failure)
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	t.Error("File is not processed in time")
+}
+
+func TestDownload(t *testing.T) {
+	url := fmt.Sprintf("%s/%d/content", Murl, TestFileID)
+
+	request, _ := http.NewRequest("GET", url, nil)
+	request.Header.Set("Range", "bytes=0-9")
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("Partial content expected: %d", resp.StatusCode)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if len(body) != 10 {
+		t.Errorf("Wrong range length: %d", len(body))
+	}
+
+	etag := resp.Header.Get("ETag")
+
+	request, _ = http.NewRequest("GET", url, nil)
+	request.Header.Set("If-None-Match", etag)
+
+	resp, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Not modified expected: %d", resp.StatusCode)
+	}
+
 	return
 }
 
+func TestPrivateShare(t *testing.T) {
+	resp := doUpload(Murl+"?visibility=private", "POST", "test_pic2.png")
+
+	u := readFileBody(resp, t)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	id := u.Data.ID
+	url := fmt.Sprintf("%s/%d", Murl, id)
+
+	resp = doRequest(url+"/content", "GET", "", "")
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Private file is public: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(url+"/share?ttl=60", "POST", "", AdminToken)
+
+	var link struct {
+		Errors []core.ErrorMsg `json:"errors"`
+		Data   files.ShareLink `json:"data"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(body, &link)
+
+	if len(link.Errors) != 0 {
+		t.Fatal(link.Errors)
+	}
+
+	resp = doRequest("http://localhost"+link.Data.URL, "GET", "", "")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Signed link does not work: %d", resp.StatusCode)
+	}
+
+	deleteFile(t, id)
+}
+
+func TestPrivateAttachment(t *testing.T) {
+	u := readFileBody(doUpload(Murl+"?visibility=private", "POST", "test_pic2.png"), t)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	fileid := u.Data.ID
+	defer deleteFile(t, fileid)
+
+	uj, _ := json.Marshal(&files.Attachment{Group: fake.Word(), FileID: int(fileid), Title: fake.Title()})
+
+	a := readAttachmentBody(doRequest(AMurl, "POST", string(uj), AdminToken), t)
+
+	if len(a.Errors) != 0 {
+		t.Fatal(a.Errors)
+	}
+
+	url := fmt.Sprintf("%s/%d", AMurl, a.Data.ID)
+	defer doRequest(url, "DELETE", "", AdminToken)
+
+	a = readAttachmentBody(doRequest(url, "GET", "", " "), t)
+
+	if a.Data.File.ID != 0 || a.Data.File.Name != "" || a.Data.File.Hash != "" {
+		t.Errorf("Private file leaks through its attachment: %+v", a.Data.File)
+	}
+
+	a = readAttachmentBody(doRequest(url, "GET", "", AdminToken), t)
+
+	if a.Data.File.ID != fileid {
+		t.Errorf("Owner must see the file: %d", a.Data.File.ID)
+	}
+
+	uj, _ = json.Marshal(&files.Attachment{Group: fake.Word(), FileID: 0, Title: fake.Title()})
+
+	a = readAttachmentBody(doRequest(AMurl, "POST", string(uj), AdminToken), t)
+
+	if len(a.Errors) == 0 {
+		t.Error("Attachment of a missing file must be rejected")
+	}
+}
+
+func TestImageTransform(t *testing.T) {
+	resp := doUpload(Murl, "POST", "test_pic1.png")
+
+	u := readFileBody(resp, t)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	id := u.Data.ID
+	url := fmt.Sprintf("%s/%d/image", Murl, id)
+
+	resp = doRequest(url+"?w=100&h=50&fit=cover", "GET", "", "")
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Unsigned transform is served: %d", resp.StatusCode)
+	}
+
+	resp = doRequest(url+"?w=100&h=50&fit=cover&format=jpeg", "POST", "", AdminToken)
+
+	var link struct {
+		Errors []core.ErrorMsg `json:"errors"`
+		Data   files.ImageLink `json:"data"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(body, &link)
+
+	if len(link.Errors) != 0 {
+		t.Fatal(link.Errors)
+	}
+
+	// the second request is served from the cache
+	for i := 0; i < 2; i++ {
+		resp = doRequest("http://localhost"+link.Data.URL, "GET", "", "")
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Signed transform does not work: %d", resp.StatusCode)
+		}
+
+		cfg, _, err := image.DecodeConfig(resp.Body)
+		if err != nil || cfg.Width != 100 || cfg.Height != 50 {
+			t.Errorf("Wrong transform: %v %dx%d", err, cfg.Width, cfg.Height)
+		}
+	}
+
+	deleteFile(t, id)
+}
+
 func TestAttachmentGetOne(t *testing.T) {
 	url := AMurl + "/0"
 	resp := doRequest(url, "GET", "", " ")
@@ -415,6 +649,130 @@ func TestGetAll(t *testing.T) {
 	return
 }
 
+func TestGetAllByType(t *testing.T) {
+	resp := doRequest(Murl+"?type=image", "GET", "", " ")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u := readFilesBody(resp, t)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if len(u.Data) == 0 {
+		t.Errorf("Wrong elements count: %d", len(u.Data))
+	}
+
+	for _, f := range u.Data {
+		if f.Type != files.TypeImage {
+			t.Errorf("Wrong type filter - : %+v", f)
+		}
+	}
+
+	return
+}
+
+func TestGetAllSorted(t *testing.T) {
+	resp := doRequest(Murl+"?sort=-size&size[gt]=0", "GET", "", " ")
+
+	u := readFilesBody(resp, t)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	for i := 1; i < len(u.Data); i++ {
+		if u.Data[i].Size > u.Data[i-1].Size {
+			t.Errorf("Wrong sort order: %d after %d", u.Data[i].Size, u.Data[i-1].Size)
+		}
+	}
+
+	resp = doRequest(Murl+"?sort=path", "GET", "", " ")
+
+	u = readFilesBody(resp, t)
+
+	if len(u.Errors) == 0 {
+		t.Error("Sort by unknown field is accepted")
+	}
+
+	return
+}
+
+func TestGetAllCursor(t *testing.T) {
+	type page struct {
+		Errors []core.ErrorMsg `json:"errors"`
+		Data   files.Files     `json:"data"`
+		Links  struct {
+			Next string `json:"next"`
+			Prev string `json:"prev"`
+		} `json:"links"`
+		Total int `json:"total"`
+	}
+
+	read := func(url string) page {
+		var p page
+		resp := doRequest(url, "GET", "", " ")
+		body, _ := ioutil.ReadAll(resp.Body)
+		json.Unmarshal(body, &p)
+		if len(p.Errors) != 0 {
+			t.Fatal(p.Errors)
+		}
+		return p
+	}
+
+	first := read(Murl + "?limit=1&total=1")
+
+	if len(first.Data) != 1 || first.Total < 2 {
+		t.Fatalf("Wrong first page: %d of %d", len(first.Data), first.Total)
+	}
+
+	if first.Links.Next == "" || first.Links.Prev != "" {
+		t.Fatalf("Wrong links: %+v", first.Links)
+	}
+
+	second := read("http://localhost" + first.Links.Next)
+
+	if len(second.Data) != 1 || second.Data[0].ID <= first.Data[0].ID {
+		t.Errorf("Wrong next page: %+v", second.Data)
+	}
+
+	back := read("http://localhost" + second.Links.Prev)
+
+	if len(back.Data) != 1 || back.Data[0].ID != first.Data[0].ID {
+		t.Errorf("Wrong prev page: %+v", back.Data)
+	}
+
+	return
+}
+
+func TestUsage(t *testing.T) {
+	resp := doRequest(Murl+"/usage", "GET", "", AdminToken)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	var u struct {
+		Errors []core.ErrorMsg `json:"errors"`
+		Data   files.Usage     `json:"data"`
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	json.Unmarshal(body, &u)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if u.Data.Files == 0 || u.Data.Bytes == 0 {
+		t.Errorf("Wrong usage: %+v", u.Data)
+	}
+
+	return
+}
+
 func TestAttachmentGetGroup(t *testing.T) {
 	// get count
 	url := AMurl
@@ -460,6 +818,44 @@ func TestAttachmentGetGroup(t *testing.T) {
 	return
 }
 
+func TestAttachmentGetOwner(t *testing.T) {
+	ownertype, _ := toUrlcode(OneOwnerType)
+
+	url := AMurl + "?ownertype=" + ownertype + "&ownerid=1"
+
+	resp := doRequest(url, "GET", "", " ")
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u := readAttachmentsBody(resp, t)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if len(u.Data) != 1 || u.Data[0].ID != OneANewID {
+		t.Fatalf("Wrong owner search: %v", u.Data)
+	}
+
+	if u.Data[0].OwnerType != OneOwnerType || u.Data[0].OwnerID != 1 {
+		t.Errorf("Wrong owner: %s %d", u.Data[0].OwnerType, u.Data[0].OwnerID)
+	}
+
+	resp = doRequest(AMurl+"?ownertype="+ownertype+"&owner_id[gt]=1", "GET", "", " ")
+
+	u = readAttachmentsBody(resp, t)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if len(u.Data) != 0 {
+		t.Errorf("Wrong owner filter count: %d", len(u.Data))
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	url := fmt.Sprintf("%s%s%d", Murl, "/", TestFileID)
 	resp := doUpload(url, "PATCH", "test_pic2.png")
@@ -501,6 +897,108 @@ func TestAttachmentUpdate(t *testing.T) {
 	return
 }
 
+func TestAttachmentOrder(t *testing.T) {
+	ids := []uint{OneANewID}
+
+	for i := 0; i < 2; i++ {
+		el := &files.Attachment{
+			Group:     OneGroup,
+			OwnerType: OneOwnerType,
+			OwnerID:   1,
+			FileID:    int(TestFileID),
+			Title:     fake.Title(),
+			IsMain:    1,
+			Index:     7,
+		}
+
+		uj, _ := json.Marshal(el)
+
+		u := readAttachmentBody(doRequest(AMurl, "POST", string(uj), AdminToken), t)
+
+		if len(u.Errors) != 0 {
+			t.Fatal(u.Errors)
+		}
+
+		if u.Data.Index != i+2 {
+			t.Errorf("Wrong auto index: %d", u.Data.Index)
+		}
+
+		ids = append(ids, u.Data.ID)
+	}
+
+	defer func() {
+		for _, id := range ids[1:] {
+			doRequest(fmt.Sprintf("%s/%d", AMurl, id), "DELETE", "", AdminToken)
+		}
+	}()
+
+	order := files.AttachmentOrder{
+		Group:     OneGroup,
+		OwnerType: OneOwnerType,
+		OwnerID:   1,
+		IDs:       []uint{ids[2], ids[0], ids[1]},
+	}
+
+	oj, _ := json.Marshal(order)
+
+	resp := doRequest(AMurl+"/order", "PUT", string(oj), AdminToken)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Success expected: %d", resp.StatusCode)
+	}
+
+	u := readAttachmentsBody(resp, t)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if len(u.Data) != 3 {
+		t.Fatalf("Wrong elements count: %d", len(u.Data))
+	}
+
+	mains := 0
+	for i, a := range u.Data {
+		if a.ID != order.IDs[i] || a.Index != i+1 {
+			t.Errorf("Wrong order at %d: %d index %d", i, a.ID, a.Index)
+		}
+		mains += a.IsMain
+	}
+
+	if mains != 1 || u.Data[0].IsMain != 1 {
+		t.Errorf("Only the last main expected: %+v", u.Data)
+	}
+
+	order.IDs = order.IDs[1:]
+	oj, _ = json.Marshal(order)
+
+	u = readAttachmentsBody(doRequest(AMurl+"/order", "PUT", string(oj), AdminToken), t)
+
+	if len(u.Errors) == 0 {
+		t.Fatal("partial order validation dont work")
+	}
+
+	// moved to another group it goes last there, the old group is renumbered
+	url := fmt.Sprintf("%s/%d", AMurl, ids[0])
+	a := readAttachmentBody(doRequest(url, "PATCH", `{"group":"moved","index":5}`, AdminToken), t)
+
+	if len(a.Errors) != 0 {
+		t.Fatal(a.Errors)
+	}
+
+	if a.Data.Group != "moved" || a.Data.Index != 1 {
+		t.Errorf("Wrong moved attachment: %+v", a.Data)
+	}
+
+	u = readAttachmentsBody(doRequest(AMurl+"?group="+OneGroup+"&ownerid=1&sort=index", "GET", "", AdminToken), t)
+
+	if len(u.Data) != 2 || u.Data[0].ID != ids[2] || u.Data[0].Index != 1 || u.Data[1].ID != ids[1] || u.Data[1].Index != 2 {
+		t.Errorf("Wrong renumbered group: %+v", u.Data)
+	}
+
+	doRequest(url, "PATCH", `{"group":"`+OneGroup+`"}`, AdminToken)
+}
+
 func TestDelete(t *testing.T) {
 	url := fmt.Sprintf("%s%s%d", Murl, "/", 0)
 
@@ -552,3 +1050,320 @@ func TestAttachmentDelete(t *testing.T) {
 
 	return
 }
+
+// fakeS3 is a tiny in-memory S3 server, enough for files.S3Storage
+func fakeS3() *httptest.Server {
+	var (
+		mu      sync.Mutex
+		objects = map[string][]byte{}
+		// parts of multipart uploads, by path and part number
+		parts = map[string]map[string][]byte{}
+	)
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		data, ok := objects[r.URL.Path]
+		q := r.URL.Query()
+
+		switch {
+		case r.Method == "POST" && q.Has("uploads"):
+			parts[r.URL.Path] = map[string][]byte{}
+			fmt.Fprintf(w, `<InitiateMultipartUploadResult><UploadId>fake</UploadId></InitiateMultipartUploadResult>`)
+			return
+		case r.Method == "POST" && q.Has("uploadId"):
+			var body []byte
+			for n := 1; n <= len(parts[r.URL.Path]); n++ {
+				body = append(body, parts[r.URL.Path][strconv.Itoa(n)]...)
+			}
+			objects[r.URL.Path] = body
+			delete(parts, r.URL.Path)
+			fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>uploads</Bucket><ETag>"fake"</ETag></CompleteMultipartUploadResult>`)
+			return
+		case r.Method == "DELETE" && q.Has("uploadId"):
+			delete(parts, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		switch r.Method {
+		case "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+				body = decodeAwsChunked(body)
+			}
+			if q.Has("partNumber") {
+				parts[r.URL.Path][q.Get("partNumber")] = body
+			} else {
+				objects[r.URL.Path] = body
+			}
+			w.Header().Set("ETag", `"fake"`)
+		case "DELETE":
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		case "GET", "HEAD":
+			if !ok {
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(http.StatusNotFound)
+				if r.Method == "GET" {
+					w.Write([]byte(`<Error><Code>NoSuchKey</Code></Error>`))
+				}
+				return
+			}
+			w.Header().Set("ETag", `"fake"`)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}
+	}))
+}
+
+// decodeAwsChunked strips the signed chunk framing used by streaming uploads
+func decodeAwsChunked(b []byte) []byte {
+	var out []byte
+	for len(b) > 0 {
+		i := bytes.Index(b, []byte("\r\n"))
+		if i < 0 {
+			break
+		}
+		var n int
+		fmt.Sscanf(string(b[:i]), "%x", &n)
+		b = b[i+2:]
+		if n == 0 || n > len(b) {
+			break
+		}
+		out = append(out, b[:n]...)
+		b = bytes.TrimPrefix(b[n:], []byte("\r\n"))
+	}
+	return out
+}
+
+func TestS3Storage(t *testing.T) {
+	srv := fakeS3()
+	defer srv.Close()
+
+	s, err := files.NewS3Storage(files.S3Config{
+		Endpoint:  strings.TrimPrefix(srv.URL, "http://"),
+		Region:    "us-east-1",
+		AccessKey: "key",
+		SecretKey: "secret",
+		Bucket:    "uploads",
+		PublicURL: "https://cdn.example.com/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := "user/day/test.txt"
+
+	if err := s.Put(key, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size != 5 {
+		t.Errorf("Wrong size: %d", info.Size)
+	}
+
+	obj, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(obj)
+	obj.Close()
+
+	if string(body) != "hello" {
+		t.Errorf("Wrong content: %s", body)
+	}
+
+	if u := s.URL(key); u != "https://cdn.example.com/"+key {
+		t.Errorf("Wrong url: %s", u)
+	}
+
+	if s.URLsExpire() {
+		t.Error("Urls of a public bucket do not expire")
+	}
+
+	// unknown size, streamed with a small part buffer
+	if err := s.Put(key+".stream", io.MultiReader(strings.NewReader("hel"), strings.NewReader("lo"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := s.Stat(key + ".stream"); err != nil || info.Size != 5 {
+		t.Errorf("Wrong streamed object: %v %v", info, err)
+	}
+
+	s.Delete(key + ".stream")
+
+	s.PublicURL = ""
+
+	if !s.URLsExpire() || !strings.Contains(s.URL(key), "X-Amz-Signature") {
+		t.Errorf("Presigned url expected: %s", s.URL(key))
+	}
+
+	if err := s.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(key); err == nil {
+		t.Error("Deleted object still exists")
+	}
+}
+
+func doTusRequest(url, proto string, headers map[string]string, body io.Reader) *http.Response {
+	request, err := http.NewRequest(proto, url, body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+AdminToken)
+	request.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return resp
+}
+
+func TestTusUpload(t *testing.T) {
+	content, err := ioutil.ReadFile("test_pic3.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := len(content) / 2
+
+	resp := doTusRequest(Murl+"/uploads", "POST", map[string]string{
+		"Upload-Length":   fmt.Sprintf("%d", len(content)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("test_pic3.png")),
+	}, nil)
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Created expected: %d", resp.StatusCode)
+	}
+
+	url := "http://localhost" + resp.Header.Get("Location")
+
+	resp = doTusRequest(url, "PATCH", map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}, bytes.NewReader(content[:half]))
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("No content expected: %d", resp.StatusCode)
+	}
+
+	resp = doTusRequest(url, "HEAD", nil, nil)
+
+	if resp.Header.Get("Upload-Offset") != fmt.Sprintf("%d", half) {
+		t.Fatalf("Wrong offset: %s", resp.Header.Get("Upload-Offset"))
+	}
+
+	if _, err := http.ParseTime(resp.Header.Get("Upload-Expires")); err != nil {
+		t.Errorf("Wrong expiry: %s", resp.Header.Get("Upload-Expires"))
+	}
+
+	resp = doTusRequest(url, "PATCH", map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}, bytes.NewReader(content))
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Offset mismatch expected: %d", resp.StatusCode)
+	}
+
+	resp = doTusRequest(url, "PATCH", map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": fmt.Sprintf("%d", half),
+	}, bytes.NewReader(content[half:]))
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("No content expected: %d", resp.StatusCode)
+	}
+
+	fileid := resp.Header.Get("X-File-ID")
+
+	resp = doRequest(Murl+"/"+fileid, "GET", "", " ")
+
+	u := readFileBody(resp, t)
+
+	if len(u.Errors) != 0 {
+		t.Fatal(u.Errors)
+	}
+
+	if u.Data.Size != int64(len(content)) {
+		t.Errorf("Wrong size: %d", u.Data.Size)
+	}
+
+	deleteFile(t, u.Data.ID)
+}
+
+func TestTusUploadRejected(t *testing.T) {
+	content := []byte("not a png at all")
+
+	resp := doTusRequest(Murl+"/uploads", "POST", map[string]string{
+		"Upload-Length":   fmt.Sprintf("%d", len(content)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("fake.png")),
+	}, nil)
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Created expected: %d", resp.StatusCode)
+	}
+
+	url := "http://localhost" + resp.Header.Get("Location")
+
+	resp = doTusRequest(url, "PATCH", map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}, bytes.NewReader(content))
+
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Unsupported media type expected: %d", resp.StatusCode)
+	}
+
+	// the rejected upload is removed with its parts
+	resp = doTusRequest(url, "HEAD", nil, nil)
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Not found expected: %d", resp.StatusCode)
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	var (
+		event string
+		valid bool
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		event = r.Header.Get("X-Webhook-Event")
+		valid = files.VerifyWebhook("secret", body, r.Header.Get("X-Webhook-Signature"))
+		if !valid {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	hook := files.Webhook{URL: srv.URL, Secret: "secret"}
+	payload := []byte(`{"event":"file.uploaded"}`)
+
+	if err := hook.Send("file.uploaded", payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if event != "file.uploaded" || !valid {
+		t.Errorf("Wrong delivery: %q %v", event, valid)
+	}
+
+	hook.Secret = "other"
+	if err := hook.Send("file.uploaded", payload); err == nil {
+		t.Error("Rejected delivery is not an error")
+	}
+}
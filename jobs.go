@@ -0,0 +1,271 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrProcessing is the Failure of a file whose processing gave up,
+// the error of the last attempt is only logged.
+var ErrProcessing = errors.New("File processing failed")
+
+// File.Status values, files go from uploaded to processing and end up
+// ready or failed after the background tasks ran.
+const (
+	StatusUploaded = iota
+	StatusProcessing
+	StatusReady
+	StatusFailed
+)
+
+// Task is a step of the background processing of a file. name is a local
+// copy of the file content, changes of file are saved when all tasks
+// succeed. Tasks are retried, so they must be safe to run again.
+type Task func(file *File, name string) error
+
+type namedTask struct {
+	name string
+	run  Task
+}
+
+// tasks are the registered steps, shared by all services.
+var tasks []namedTask
+
+// RegisterTask adds a processing step run after the built in ones,
+// e.g. a virus scan. Call it before Configure.
+func RegisterTask(name string, t Task) {
+	tasks = append(tasks, namedTask{name, t})
+}
+
+// steps lists the built in tasks followed by the registered ones.
+func (s *Service) steps() []namedTask {
+	return append([]namedTask{
+		{"metadata", metadataTask},
+		{"variants", s.variantsTask},
+	}, tasks...)
+}
+
+// FileJob is a queued processing of a file, kept in the db
+// so it survives restarts and is shared by all app replicas.
+type FileJob struct {
+	gorm.Model
+	FileID      uint       `json:"fileID"`
+	Attempts    int        `json:"attempts"`
+	RunAt       time.Time  `json:"runAt" gorm:"index"`
+	LockedUntil *time.Time `json:"lockedUntil"`
+	Error       string     `json:"error" gorm:"type:text"`
+	Namespace   string     `json:"-" gorm:"type:varchar(100);not null;default:'';index"`
+}
+
+// enqueue schedules the processing of the file,
+// files sharing an already processed blob are ready at once.
+func (s *Service) enqueue(file *File) {
+	if file.Status == StatusReady {
+		return
+	}
+
+	file.Status = StatusUploaded
+	file.Failure = ""
+	s.App.DB.Model(file).Updates(map[string]interface{}{
+		"status":  StatusUploaded,
+		"failure": "",
+	})
+
+	s.App.DB.Create(&FileJob{FileID: file.ID, RunAt: time.Now(), Namespace: s.Opts.Namespace})
+
+	s.notify()
+}
+
+// notify wakes an idle worker, call it after the queued rows are committed.
+func (s *Service) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Service) startWorkers() {
+	for i := 0; i < s.Opts.Workers; i++ {
+		go s.worker()
+	}
+}
+
+func (s *Service) worker() {
+	ticker := time.NewTicker(s.Opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for s.runNextJob() {
+		}
+		for s.runNextDelivery() {
+		}
+		for s.removeExpiredUploads() {
+		}
+
+		select {
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+// FileJob and WebhookDelivery rows are queued work shared by the workers
+// of all replicas. A row is due from its RunAt, a worker claims it by
+// setting LockedUntil, so a crashed worker only holds it until then.
+// Failures are retried with exponential backoff.
+
+// claim loads the next due row of the table of dest, from db with the
+// conditions of the queue, into dest and locks it for timeout. found is
+// false when nothing is due, claimed is false when another worker took
+// the row first.
+func claim(db *gorm.DB, dest interface{}, timeout time.Duration) (found, claimed bool) {
+	now := time.Now()
+	db.
+		Where("run_at <= ? AND (locked_until IS NULL OR locked_until < ?)", now, now).
+		Order("run_at").
+		First(dest)
+
+	if db.NewScope(dest).PrimaryKeyZero() {
+		return false, false
+	}
+
+	res := db.Model(dest).
+		Where("locked_until IS NULL OR locked_until < ?", now).
+		Update("locked_until", now.Add(timeout))
+
+	return true, res.RowsAffected != 0
+}
+
+// retry unlocks the row after its failed attempt, to run again after
+// 1, 2, 4... times the delay.
+func retry(db *gorm.DB, row interface{}, attempts int, delay time.Duration, err error) {
+	db.Model(row).Updates(map[string]interface{}{
+		"attempts":     attempts,
+		"run_at":       time.Now().Add(delay << uint(attempts-1)),
+		"locked_until": nil,
+		"error":        err.Error(),
+	})
+}
+
+// runNextJob claims and runs one due job, it reports false
+// when there is nothing to do.
+func (s *Service) runNextJob() bool {
+	var job FileJob
+
+	found, claimed := claim(s.scoped(s.App.DB), &job, s.Opts.JobTimeout)
+	if !claimed {
+		return found
+	}
+
+	err := s.processFile(job.FileID)
+	if err == nil {
+		s.App.DB.Unscoped().Delete(&job)
+		return true
+	}
+
+	job.Attempts++
+	if job.Attempts >= s.Opts.MaxAttempts {
+		// the error may name local paths and storage details
+		log.Printf("File %d processing failed: %v", job.FileID, err)
+		s.App.DB.Model(&File{}).Where("id = ?", job.FileID).Updates(map[string]interface{}{
+			"status":  StatusFailed,
+			"failure": ErrProcessing.Error(),
+		})
+		s.App.DB.Unscoped().Delete(&job)
+		return true
+	}
+
+	retry(s.App.DB, &job, job.Attempts, s.Opts.RetryDelay, err)
+
+	return true
+}
+
+// processFile runs all tasks on a local copy of the file content.
+func (s *Service) processFile(id uint) (err error) {
+	var file File
+
+	s.App.DB.First(&file, id)
+	if file.ID == 0 {
+		// deleted meanwhile, nothing to do
+		return nil
+	}
+
+	hash := file.Hash
+
+	s.App.DB.Model(&file).Update("status", StatusProcessing)
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Task panic: %v", r)
+			log.Println(err)
+		}
+	}()
+
+	name, err := s.localCopy(file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(name)
+
+	for _, t := range s.steps() {
+		if err := t.run(&file, name); err != nil {
+			return fmt.Errorf("%s: %s", t.name, err)
+		}
+	}
+
+	// the content could be replaced while the tasks ran
+	var current File
+	s.App.DB.First(&current, id)
+	if current.ID == 0 || current.Hash != hash {
+		return nil
+	}
+
+	file.Status = StatusReady
+	file.Failure = ""
+	s.App.DB.Save(&file)
+
+	return nil
+}
+
+// localCopy downloads the file content from the storage to a temp file.
+func (s *Service) localCopy(file File) (string, error) {
+	obj, err := s.storageOf(file).Get(file.Path)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Close()
+
+	tmp, err := ioutil.TempFile(s.Opts.TempDir, "process-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(tmp, obj)
+	tmp.Close()
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+func (s *Service) variantsTask(file *File, name string) error {
+	variants, err := makeVariants(s.storageOf(*file), s.Opts.Presets, file.Path, name, s.Opts.MaxImagePixels)
+	if err != nil {
+		return err
+	}
+
+	file.Variants = variants
+	file.Preset = variants.presetNames(s.Opts.Presets)
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestJobFailure(t *testing.T) {
+	s := newTestService(t, WithRetries(1, time.Millisecond))
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := s.Save(context.Background(), 1, "a.png", bytes.NewReader(pic), SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the local copy fails with an error naming the storage dir
+	s.Opts.Storage.Delete(file.Path)
+
+	for s.runNextJob() {
+	}
+
+	s.App.DB.First(&file, file.ID)
+	if file.Status != StatusFailed || file.Failure != ErrProcessing.Error() {
+		t.Errorf("Wrong failed file: %d %q", file.Status, file.Failure)
+	}
+}
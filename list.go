@@ -0,0 +1,415 @@
+package files
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-rest-framework/core"
+	"github.com/jinzhu/gorm"
+)
+
+// Types of the filterable columns, they decide how values are parsed.
+const (
+	fieldInt = iota
+	fieldString
+	fieldTime
+)
+
+type listField struct {
+	column string
+	kind   int
+	sort   bool
+}
+
+// listSpec declares the columns a list endpoint lets clients sort by
+// ("sort=-size,name") and filter with typed operators ("size[gt]=1000",
+// "created_at[between]=2020-01-01,2020-02-01"). Anything else is rejected,
+// values never reach the sql as text.
+type listSpec map[string]listField
+
+var fileList = listSpec{
+	"id":         {"id", fieldInt, true},
+	"user_id":    {"user_id", fieldInt, true},
+	"name":       {"name", fieldString, true},
+	"ext":        {"ext", fieldString, true},
+	"mime":       {"mime", fieldString, false},
+	"size":       {"size", fieldInt, true},
+	"type":       {"type", fieldInt, true},
+	"status":     {"status", fieldInt, true},
+	"created_at": {"created_at", fieldTime, true},
+	"updated_at": {"updated_at", fieldTime, true},
+}
+
+var attachmentList = listSpec{
+	"id":         {"id", fieldInt, true},
+	"user_id":    {"user_id", fieldInt, true},
+	"file_id":    {"file_id", fieldInt, true},
+	"group":      {"group", fieldString, true},
+	"owner_type": {"owner_type", fieldString, true},
+	"owner_id":   {"owner_id", fieldInt, true},
+	"title":      {"title", fieldString, true},
+	"is_main":    {"is_main", fieldInt, true},
+	"index":      {"index", fieldInt, true},
+	"created_at": {"created_at", fieldTime, true},
+	"updated_at": {"updated_at", fieldTime, true},
+}
+
+var listOperators = map[string]string{
+	"eq":  "=",
+	"ne":  "<>",
+	"gt":  ">",
+	"gte": ">=",
+	"lt":  "<",
+	"lte": "<=",
+}
+
+var filterParam = regexp.MustCompile(`^(\w+)\[(\w+)\]$`)
+
+type sortKey struct {
+	field listField
+	desc  bool
+}
+
+// listQuery is a parsed list request: the filtered db, the order, the page
+// size and the keyset cursor. Pages after a cursor start right behind its
+// row, so they stay fast and stable on big tables, unlike offsets.
+type listQuery struct {
+	db     *gorm.DB
+	req    *http.Request
+	sort   []sortKey
+	order  string
+	limit  int
+	offset int
+	cursor []string
+	before bool
+	total  bool
+
+	Links listLinks
+	Total *int
+}
+
+type listLinks struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// cursor is the position of a row in a list, base64 json in the
+// "after" and "before" params.
+type cursor struct {
+	Order  string   `json:"o"`
+	Values []string `json:"v"`
+}
+
+// query reads the filters, the order and the page of the request.
+// The order always ends with the id, so every row has a unique position.
+func (spec listSpec) query(db *gorm.DB, r *http.Request, maxPage int) (*listQuery, error) {
+	q := r.URL.Query()
+	l := &listQuery{req: r, limit: maxPage, total: q.Get("total") != ""}
+
+	for param, values := range q {
+		m := filterParam.FindStringSubmatch(param)
+		if m == nil {
+			continue
+		}
+
+		field, ok := spec[m[1]]
+		if !ok {
+			return nil, fmt.Errorf("Unknown filter field %q", m[1])
+		}
+
+		var err error
+		if db, err = field.filter(db, m[2], values[0]); err != nil {
+			return nil, err
+		}
+	}
+	l.db = db
+
+	var names []string
+	for _, name := range strings.Split(q.Get("sort")+",id", ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		desc := strings.HasPrefix(name, "-")
+		field, ok := spec[strings.TrimPrefix(name, "-")]
+		if !ok || !field.sort {
+			return nil, fmt.Errorf("Unknown sort field %q", name)
+		}
+
+		l.sort = append(l.sort, sortKey{field, desc})
+		names = append(names, name)
+
+		if field.column == "id" {
+			break
+		}
+	}
+	l.order = strings.Join(names, ",")
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("Invalid limit %q", s)
+		}
+		if n < l.limit {
+			l.limit = n
+		}
+	}
+
+	if s := q.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid offset %q", s)
+		}
+		l.offset = n
+	}
+
+	token := q.Get("after")
+	if q.Get("before") != "" {
+		token, l.before = q.Get("before"), true
+	}
+	if token != "" {
+		var c cursor
+		b, err := base64.RawURLEncoding.DecodeString(token)
+		if err == nil {
+			err = json.Unmarshal(b, &c)
+		}
+		if err != nil || c.Order != l.order || len(c.Values) != len(l.sort) {
+			return nil, errors.New("Invalid cursor")
+		}
+		for i, v := range c.Values {
+			if _, err := l.sort[i].field.parse(v); err != nil {
+				return nil, errors.New("Invalid cursor")
+			}
+		}
+		l.cursor = c.Values
+	}
+
+	return l, nil
+}
+
+func quote(column string) string {
+	return "`" + column + "`"
+}
+
+// find loads the page into out, a pointer to a slice of models,
+// and sets the links and the total.
+func (l *listQuery) find(out interface{}, preload ...string) {
+	if l.total {
+		var total int
+		l.db.Model(out).Count(&total)
+		l.Total = &total
+	}
+
+	db := l.db
+	for _, p := range preload {
+		db = db.Preload(p)
+	}
+
+	for _, k := range l.sort {
+		// pages before a cursor are read backwards
+		dir := " ASC"
+		if k.desc != l.before {
+			dir = " DESC"
+		}
+		db = db.Order(quote(k.field.column) + dir)
+	}
+
+	if l.cursor != nil {
+		where, args := l.keyset()
+		db = db.Where(where, args...)
+	} else if l.offset > 0 {
+		db = db.Offset(l.offset)
+	}
+
+	// one more row tells if there is a next page
+	db.Limit(l.limit + 1).Find(out)
+
+	rows := reflect.ValueOf(out).Elem()
+	more := rows.Len() > l.limit
+	if more {
+		rows.Set(rows.Slice(0, l.limit))
+	}
+
+	if l.before {
+		for i, j := 0, rows.Len()-1; i < j; i, j = i+1, j-1 {
+			a, b := rows.Index(i).Interface(), rows.Index(j).Interface()
+			rows.Index(i).Set(reflect.ValueOf(b))
+			rows.Index(j).Set(reflect.ValueOf(a))
+		}
+	}
+
+	if rows.Len() == 0 {
+		return
+	}
+
+	if more || l.before {
+		l.Links.Next = l.link("after", l.position(rows.Index(rows.Len()-1)))
+	}
+	if (more && l.before) || (!l.before && (l.cursor != nil || l.offset > 0)) {
+		l.Links.Prev = l.link("before", l.position(rows.Index(0)))
+	}
+}
+
+// keyset is the condition selecting the rows behind (or before) the
+// cursor: (a > x) OR (a = x AND b > y) OR ...
+func (l *listQuery) keyset() (string, []interface{}) {
+	var (
+		ors  []string
+		args []interface{}
+		eqs  []string
+		eqa  []interface{}
+	)
+
+	for i, k := range l.sort {
+		v, _ := k.field.parse(l.cursor[i])
+
+		op := " > ?"
+		if k.desc != l.before {
+			op = " < ?"
+		}
+
+		ors = append(ors, "("+strings.Join(append(eqs, quote(k.field.column)+op), " AND ")+")")
+		args = append(append(args, eqa...), v)
+
+		eqs = append(eqs, quote(k.field.column)+" = ?")
+		eqa = append(eqa, v)
+	}
+
+	return strings.Join(ors, " OR "), args
+}
+
+// position returns the cursor of the row.
+func (l *listQuery) position(row reflect.Value) string {
+	scope := l.db.NewScope(row.Addr().Interface())
+
+	c := cursor{Order: l.order}
+	for _, k := range l.sort {
+		var v string
+		if f, ok := scope.FieldByName(k.field.column); ok {
+			switch x := f.Field.Interface().(type) {
+			case time.Time:
+				v = x.Format(time.RFC3339Nano)
+			default:
+				v = fmt.Sprint(x)
+			}
+		}
+		c.Values = append(c.Values, v)
+	}
+
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (l *listQuery) link(param, position string) string {
+	q := l.req.URL.Query()
+	q.Del("after")
+	q.Del("before")
+	q.Del("offset")
+	q.Del("total")
+	q.Set(param, position)
+
+	return l.req.URL.Path + "?" + q.Encode()
+}
+
+// writeList writes the response with the links and the total
+// of the page next to the data.
+func writeList(w http.ResponseWriter, rsp *core.Response, l *listQuery) {
+	body := rsp.Make()
+
+	var envelope map[string]json.RawMessage
+	if l == nil || json.Unmarshal(body, &envelope) != nil {
+		w.Write(body)
+		return
+	}
+
+	envelope["links"], _ = json.Marshal(l.Links)
+	if l.Total != nil {
+		envelope["total"], _ = json.Marshal(*l.Total)
+	}
+
+	body, _ = json.Marshal(envelope)
+	w.Write(body)
+}
+
+func (f listField) filter(db *gorm.DB, op, value string) (*gorm.DB, error) {
+	column := quote(f.column)
+
+	switch op {
+	case "between":
+		bounds := strings.SplitN(value, ",", 2)
+		if len(bounds) != 2 {
+			return db, fmt.Errorf("Invalid range %q", value)
+		}
+
+		from, err := f.parse(bounds[0])
+		if err != nil {
+			return db, err
+		}
+		to, err := f.parse(bounds[1])
+		if err != nil {
+			return db, err
+		}
+
+		return db.Where(column+" BETWEEN ? AND ?", from, to), nil
+	case "in":
+		var list []interface{}
+		for _, s := range strings.Split(value, ",") {
+			v, err := f.parse(s)
+			if err != nil {
+				return db, err
+			}
+			list = append(list, v)
+		}
+
+		return db.Where(column+" IN (?)", list), nil
+	}
+
+	sqlOp, ok := listOperators[op]
+	if !ok {
+		return db, fmt.Errorf("Unknown filter operator %q", op)
+	}
+
+	v, err := f.parse(value)
+	if err != nil {
+		return db, err
+	}
+
+	return db.Where(column+" "+sqlOp+" ?", v), nil
+}
+
+// parse reads a value of the field type, times are RFC 3339,
+// dates (2006-01-02) or unix seconds.
+func (f listField) parse(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+
+	switch f.kind {
+	case fieldInt:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid number %q", s)
+		}
+		return n, nil
+	case fieldTime:
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, nil
+		}
+		if t, err := time.Parse("2006-01-02", s); err == nil {
+			return t, nil
+		}
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(n, 0), nil
+		}
+		return nil, fmt.Errorf("Invalid time %q", s)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,194 @@
+package files
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Metadata describes the content of a file, for now only images.
+// Width and Height are the display size, already swapped for
+// images rotated by their EXIF orientation.
+type Metadata struct {
+	Width       int        `json:"width,omitempty"`
+	Height      int        `json:"height,omitempty"`
+	Orientation int        `json:"orientation,omitempty"`
+	Make        string     `json:"make,omitempty"`
+	Model       string     `json:"model,omitempty"`
+	TakenAt     *time.Time `json:"takenAt,omitempty"`
+}
+
+func (m Metadata) Value() (driver.Value, error) {
+	if m == (Metadata{}) {
+		return "", nil
+	}
+
+	return jsonValue(m)
+}
+
+func (m *Metadata) Scan(src interface{}) error {
+	*m = Metadata{}
+	return jsonScan(src, m)
+}
+
+// ExifData is the EXIF of an image kept on the server only, in File.Exif.
+// It is the only copy of the camera and location of sanitized images.
+type ExifData struct {
+	Make      string     `json:"make,omitempty"`
+	Model     string     `json:"model,omitempty"`
+	TakenAt   *time.Time `json:"takenAt,omitempty"`
+	Latitude  float64    `json:"latitude,omitempty"`
+	Longitude float64    `json:"longitude,omitempty"`
+}
+
+func (e ExifData) Value() (driver.Value, error) {
+	if e == (ExifData{}) {
+		return "", nil
+	}
+
+	return jsonValue(e)
+}
+
+func (e *ExifData) Scan(src interface{}) error {
+	*e = ExifData{}
+	return jsonScan(src, e)
+}
+
+func jsonValue(v interface{}) (driver.Value, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// jsonScan reads a json column into v, empty columns leave v untouched.
+func jsonScan(src interface{}, v interface{}) error {
+	var b []byte
+	switch s := src.(type) {
+	case []byte:
+		b = s
+	case string:
+		b = []byte(s)
+	case nil:
+	default:
+		return fmt.Errorf("Can't scan %T into %T", src, v)
+	}
+
+	if len(b) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// readMetadata extracts the size and EXIF data of the image in
+// the local file name, other files give empty metadata.
+func readMetadata(name string) (Metadata, ExifData, error) {
+	var (
+		meta Metadata
+		data ExifData
+	)
+
+	f, err := os.Open(name)
+	if err != nil {
+		return meta, data, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		// not an image
+		return meta, data, nil
+	}
+
+	meta.Width, meta.Height = cfg.Width, cfg.Height
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return meta, data, err
+	}
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		// no or broken EXIF is common, keep the size
+		return meta, data, nil
+	}
+
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		meta.Orientation, _ = tag.Int(0)
+	}
+
+	if tag, err := x.Get(exif.Make); err == nil {
+		s, _ := tag.StringVal()
+		data.Make = strings.TrimSpace(s)
+	}
+
+	if tag, err := x.Get(exif.Model); err == nil {
+		s, _ := tag.StringVal()
+		data.Model = strings.TrimSpace(s)
+	}
+
+	if t, err := x.DateTime(); err == nil {
+		data.TakenAt = &t
+	}
+
+	if lat, lng, err := x.LatLong(); err == nil {
+		data.Latitude, data.Longitude = lat, lng
+	}
+
+	// images keeping their EXIF publish it anyway, so does the api,
+	// except the location
+	meta.Make, meta.Model, meta.TakenAt = data.Make, data.Model, data.TakenAt
+
+	// orientations 5-8 are rotated by 90 degrees
+	if meta.Orientation >= 5 && meta.Orientation <= 8 {
+		meta.Width, meta.Height = meta.Height, meta.Width
+	}
+
+	return meta, data, nil
+}
+
+var ErrImageTooLarge = errors.New("Image is too large")
+
+// openImage decodes the image in the local file name, rotated by its
+// EXIF orientation. The size is read from the header first, so images
+// over maxPixels are rejected before their pixels are allocated.
+func openImage(name string, maxPixels int) (image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Width <= 0 || cfg.Height <= 0 || int64(cfg.Width)*int64(cfg.Height) > int64(maxPixels) {
+		return nil, ErrImageTooLarge
+	}
+
+	return imaging.Open(name, imaging.AutoOrientation(true))
+}
+
+func metadataTask(file *File, name string) error {
+	meta, data, err := readMetadata(name)
+	if err != nil {
+		return err
+	}
+
+	file.Meta = meta
+
+	// EXIF of sanitized images was read on upload, before it was stripped
+	if data != (ExifData{}) {
+		file.Exif = data
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package files
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	maxNameLength = 200
+	maxExtLength  = 10
+	maxSlugLength = 50
+)
+
+// splitName cleans a client supplied filename and splits it into
+// the display name and the extension. Directories (also windows ones),
+// control and reserved characters are dropped, unicode is NFC normalized.
+func splitName(name string) (string, string) {
+	name = norm.NFC.String(name)
+
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsSpace(r):
+			return ' '
+		case r == utf8.RuneError, unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+
+	name = strings.Join(strings.Fields(name), " ")
+	name = strings.Trim(name, ". ")
+
+	ext := path.Ext(name)
+	if len(ext) > maxExtLength || ext == name {
+		ext = ""
+	}
+
+	base := strings.TrimSpace(strings.TrimSuffix(name, ext))
+	if base == "" {
+		base = "file"
+	}
+
+	return truncate(base, maxNameLength), ext
+}
+
+// truncate cuts s to at most n bytes without breaking runes.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// slug makes an ascii, url safe version of the name for storage keys.
+func slug(name string) string {
+	var b strings.Builder
+	dash := false
+
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'):
+			b.WriteRune(r)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+
+	return strings.Trim(truncate(b.String(), maxSlugLength), "-")
+}
+
+// storageName is a unique file name for a storage key, so files with the
+// same display name never overwrite each other.
+func storageName(name, ext string) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	s := slug(name)
+	if s != "" {
+		s += "-"
+	}
+
+	return s + hex.EncodeToString(id) + strings.ToLower(ext), nil
+}
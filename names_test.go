@@ -0,0 +1,75 @@
+package files
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSplitName(t *testing.T) {
+	cases := []struct {
+		in, name, ext string
+	}{
+		{"photo.JPG", "photo", ".JPG"},
+		{"archive.tar.gz", "archive.tar", ".gz"},
+		{"../../etc/passwd", "passwd", ""},
+		{"..\\..\\windows\\system.ini", "system", ".ini"},
+		{"C:\\Users\\me\\cv.pdf", "cv", ".pdf"},
+		{"a\x00b\x1fc.txt", "abc", ".txt"},
+		{"in\u200bvisible\u202e.txt", "invisible", ".txt"},
+		{"tab\tand\nnewline.txt", "tab and newline", ".txt"},
+		{`what<>:"|?*.txt`, "what_______", ".txt"},
+		{"  spaced   out  .txt", "spaced out", ".txt"},
+		{"cafe\u0301.txt", "caf\u00e9", ".txt"},
+		{".htaccess", "htaccess", ""},
+		{"...", "file", ""},
+		{"", "file", ""},
+		{"name.verylongextension", "name.verylongextension", ""},
+		{"bad\xffutf8.txt", "badutf8", ".txt"},
+	}
+
+	for _, c := range cases {
+		name, ext := splitName(c.in)
+		if name != c.name || ext != c.ext {
+			t.Errorf("splitName(%q) = %q, %q, want %q, %q", c.in, name, ext, c.name, c.ext)
+		}
+	}
+
+	long := strings.Repeat("ж", maxNameLength) + ".txt"
+	name, ext := splitName(long)
+	if len(name) > maxNameLength || !strings.HasPrefix(long, name) || ext != ".txt" {
+		t.Errorf("Wrong long name: %d bytes, %q", len(name), ext)
+	}
+}
+
+func TestStorageName(t *testing.T) {
+	valid := regexp.MustCompile(`^([a-z0-9_]+(-[a-z0-9_]+)*-)?[0-9a-f]{16}(\.[^/\\]*)?$`)
+
+	cases := []struct {
+		name, ext, prefix string
+	}{
+		{"My Photo", ".JPG", "my-photo-"},
+		{"Привет мир", ".png", ""},
+		{"../../etc", "", "etc-"},
+		{"a//b\\c", ".txt", "a-b-c-"},
+		{strings.Repeat("x", 300), ".txt", strings.Repeat("x", maxSlugLength) + "-"},
+	}
+
+	for _, c := range cases {
+		key, err := storageName(c.name, c.ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !valid.MatchString(key) || !strings.HasPrefix(key, c.prefix) ||
+			!strings.HasSuffix(key, strings.ToLower(c.ext)) {
+			t.Errorf("storageName(%q, %q) = %q", c.name, c.ext, key)
+		}
+	}
+
+	a, _ := storageName("same", ".txt")
+	b, _ := storageName("same", ".txt")
+	if a == b {
+		t.Errorf("Names must be unique: %s", a)
+	}
+}
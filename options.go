@@ -0,0 +1,222 @@
+package files
+
+import "time"
+
+// Options holds module settings that are not part of core.Config.
+type Options struct {
+	// Namespace keeps the files, attachments, uploads and queues of
+	// services sharing a db apart, empty by default. Every row the
+	// service creates holds it in its Namespace column and every query
+	// of the service matches it. UserQuota rows are shared by all of them.
+	Namespace string
+	Storage   Storage
+	// PrivateStorage keeps private files, it must not be publicly reachable.
+	PrivateStorage Storage
+	// SigningKey signs share links, a random key is used when empty
+	// which makes links invalid after restart and across replicas.
+	SigningKey []byte
+	// MaxUploadSize limits the size of one file in bytes, 0 means no limit.
+	MaxUploadSize int64
+	// UploadExpiry is how long an unfinished resumable upload is kept
+	// after its last PATCH, 24 hours by default.
+	UploadExpiry time.Duration
+	// TempDir keeps files while they are uploaded, os.TempDir() when empty.
+	TempDir string
+	// Presets are the image sizes generated for every uploaded image.
+	Presets []Preset
+	// MaxPageSize limits the items of a list page, 100 by default.
+	MaxPageSize int
+	// MaxTransformSize limits the width and height of on request
+	// image transforms, 2048 by default.
+	MaxTransformSize int
+	// MaxImagePixels limits the width x height of images decoded for
+	// sanitizing, presets and transforms, 50 megapixels by default.
+	// Their pixels are held in memory, 4 bytes each.
+	MaxImagePixels int
+	// Dedup stores equal content once, under a key made of its hash.
+	Dedup bool
+	// Policies limit uploaded file types by user role, "*" applies to
+	// roles without their own policy. DefaultPolicy is used when empty.
+	Policies map[string]Policy
+	// StripMetadata rewrites JPEG and PNG uploads without EXIF and text
+	// chunks, rotated by their orientation. KeepMetadata saves what was
+	// read from them in File.Exif first, which is never published.
+	StripMetadata bool
+	KeepMetadata  bool
+	// Quotas limit the storage of users by role, a UserQuota row
+	// overrides the role quota.
+	Quotas map[string]Quota
+	// Workers is the number of background processing goroutines,
+	// a negative value disables them (e.g. they run in another process).
+	Workers      int
+	PollInterval time.Duration
+	// JobTimeout is how long a job stays locked by a worker.
+	JobTimeout  time.Duration
+	MaxAttempts int
+	// RetryDelay is the delay before the first retry, doubled every time.
+	RetryDelay time.Duration
+	// Webhooks receive the file and attachment events, failed deliveries
+	// are retried WebhookAttempts times starting after WebhookRetryDelay.
+	Webhooks          []Webhook
+	WebhookAttempts   int
+	WebhookRetryDelay time.Duration
+}
+
+// Option changes module settings, pass them to Configure.
+type Option func(*Options)
+
+// Opts are the options of the Default service.
+var Opts Options
+
+// WithNamespace sets the namespace of the service rows in the db.
+func WithNamespace(ns string) Option {
+	return func(o *Options) {
+		o.Namespace = ns
+	}
+}
+
+// WithStorage replaces the default local disk storage.
+func WithStorage(s Storage) Option {
+	return func(o *Options) {
+		o.Storage = s
+	}
+}
+
+// WithPrivateStorage replaces the default storage of private files.
+func WithPrivateStorage(s Storage) Option {
+	return func(o *Options) {
+		o.PrivateStorage = s
+	}
+}
+
+// WithSigningKey sets the HMAC key of share links.
+func WithSigningKey(key []byte) Option {
+	return func(o *Options) {
+		o.SigningKey = key
+	}
+}
+
+// WithMaxUploadSize limits the size of uploaded files.
+func WithMaxUploadSize(n int64) Option {
+	return func(o *Options) {
+		o.MaxUploadSize = n
+	}
+}
+
+// WithUploadExpiry sets how long unfinished resumable uploads are kept.
+func WithUploadExpiry(d time.Duration) Option {
+	return func(o *Options) {
+		o.UploadExpiry = d
+	}
+}
+
+// WithTempDir sets the dir for files being uploaded, keep it on the same
+// device as the local storage so finished uploads are just renamed.
+func WithTempDir(dir string) Option {
+	return func(o *Options) {
+		o.TempDir = dir
+	}
+}
+
+// WithPresets declares image presets, e.g. "thumb 150x150 crop" or
+// "medium 800w fit", see ParsePreset. It panics on invalid declarations.
+func WithPresets(presets ...string) Option {
+	return func(o *Options) {
+		for _, s := range presets {
+			p, err := ParsePreset(s)
+			if err != nil {
+				panic(err)
+			}
+			o.Presets = append(o.Presets, p)
+		}
+	}
+}
+
+// WithDedup turns on content-addressed storage of uploads.
+func WithDedup() Option {
+	return func(o *Options) {
+		o.Dedup = true
+	}
+}
+
+// WithPolicy sets the upload policy of a role, "*" for all other roles.
+func WithPolicy(role string, p Policy) Option {
+	return func(o *Options) {
+		if o.Policies == nil {
+			o.Policies = map[string]Policy{}
+		}
+		o.Policies[role] = p
+	}
+}
+
+// WithQuota limits the storage of every user with the role.
+func WithQuota(role string, q Quota) Option {
+	return func(o *Options) {
+		if o.Quotas == nil {
+			o.Quotas = map[string]Quota{}
+		}
+		o.Quotas[role] = q
+	}
+}
+
+// WithWorkers sets the number of background workers, -1 disables them.
+func WithWorkers(n int) Option {
+	return func(o *Options) {
+		o.Workers = n
+	}
+}
+
+// WithRetries sets the attempts of failing jobs and the first retry delay.
+func WithRetries(attempts int, delay time.Duration) Option {
+	return func(o *Options) {
+		o.MaxAttempts = attempts
+		o.RetryDelay = delay
+	}
+}
+
+// WithStripMetadata removes metadata from uploaded images,
+// keep saves it server side in File.Exif.
+func WithStripMetadata(keep bool) Option {
+	return func(o *Options) {
+		o.StripMetadata = true
+		o.KeepMetadata = keep
+	}
+}
+
+// WithMaxTransformSize limits the size of on request image transforms.
+func WithMaxTransformSize(px int) Option {
+	return func(o *Options) {
+		o.MaxTransformSize = px
+	}
+}
+
+// WithMaxImagePixels limits the size of the images that are decoded.
+func WithMaxImagePixels(n int) Option {
+	return func(o *Options) {
+		o.MaxImagePixels = n
+	}
+}
+
+// WithWebhook posts the events (all when none are listed)
+// to the url, signed with the secret.
+func WithWebhook(url, secret string, events ...string) Option {
+	return func(o *Options) {
+		o.Webhooks = append(o.Webhooks, Webhook{URL: url, Secret: secret, Events: events})
+	}
+}
+
+// WithWebhookRetries sets how many times a webhook delivery is tried
+// and the delay of the first retry, doubled after every failure.
+func WithWebhookRetries(attempts int, delay time.Duration) Option {
+	return func(o *Options) {
+		o.WebhookAttempts = attempts
+		o.WebhookRetryDelay = delay
+	}
+}
+
+// WithMaxPageSize limits the items returned by one list request.
+func WithMaxPageSize(n int) Option {
+	return func(o *Options) {
+		o.MaxPageSize = n
+	}
+}
@@ -0,0 +1,62 @@
+package files
+
+import "github.com/jinzhu/gorm"
+
+// Models of other packages own attachments through a gorm polymorphic
+// relation on OwnerType and OwnerID:
+//
+//	type Post struct {
+//		gorm.Model
+//		Attachments files.Attachments `gorm:"polymorphic:Owner"`
+//	}
+//
+//	db.Scopes(files.PreloadAttachments("Attachments")).Find(&posts)
+//
+// Clients attach files to a post with ownerType "posts", the table name.
+
+// OwnerTypeOf returns the OwnerType of the attachments of model.
+func OwnerTypeOf(db *gorm.DB, model interface{}) string {
+	return db.NewScope(model).TableName()
+}
+
+// PreloadAttachments is the PreloadAttachments scope of the Default service.
+func PreloadAttachments(relation string, groups ...string) func(*gorm.DB) *gorm.DB {
+	return Default.PreloadAttachments(relation, groups...)
+}
+
+// AttachmentsOf returns the attachments of the model in the Default service.
+func AttachmentsOf(db *gorm.DB, model interface{}, groups ...string) Attachments {
+	return Default.AttachmentsOf(db, model, groups...)
+}
+
+// PreloadAttachments is a scope preloading the attachments relation with
+// their files, ordered by index. groups limit it to these groups.
+func (s *Service) PreloadAttachments(relation string, groups ...string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.
+			Preload(relation, func(db *gorm.DB) *gorm.DB {
+				db = s.scoped(db)
+				if len(groups) > 0 {
+					db = db.Where("`group` IN (?)", groups)
+				}
+				return db.Order("`index`").Order("id")
+			}).
+			Preload(relation + ".File")
+	}
+}
+
+// AttachmentsOf returns the attachments of the model ordered by index,
+// with their files.
+func (s *Service) AttachmentsOf(db *gorm.DB, model interface{}, groups ...string) Attachments {
+	var attachments Attachments
+
+	scope := db.NewScope(model)
+	db = s.scoped(db).Preload("File").
+		Where("owner_type = ? AND owner_id = ?", scope.TableName(), scope.PrimaryKeyValue())
+	if len(groups) > 0 {
+		db = db.Where("`group` IN (?)", groups)
+	}
+	db.Order("`index`").Order("id").Find(&attachments)
+
+	return attachments
+}
@@ -0,0 +1,157 @@
+package files
+
+import (
+	"errors"
+	"mime"
+	"strings"
+
+	"github.com/gabriel-vasile/mimetype"
+)
+
+var (
+	ErrMimeMismatch = errors.New("File content does not match its extension")
+	ErrNotAllowed   = errors.New("File type is not allowed")
+)
+
+// Policy decides which files a role may upload. Mime patterns may end
+// with "*" ("image/*"), extensions include the dot. Empty allow lists allow anything
+// that is not denied.
+type Policy struct {
+	AllowMime []string
+	AllowExt  []string
+	DenyMime  []string
+	DenyExt   []string
+}
+
+// DefaultPolicy denies files that browsers would run as code
+// when served from the web root.
+var DefaultPolicy = Policy{
+	DenyMime: []string{
+		"text/html",
+		"application/xhtml+xml",
+		"image/svg+xml",
+		"text/javascript",
+		"application/javascript",
+		"application/x-php",
+		"text/x-php",
+	},
+	DenyExt: []string{
+		".php", ".phtml", ".php3", ".php4", ".php5", ".phar",
+		".html", ".htm", ".xhtml", ".shtml",
+		".svg", ".js", ".mjs",
+		".cgi", ".pl", ".asp", ".aspx", ".jsp",
+		".htaccess",
+	},
+}
+
+// policyFor returns the policy of the role, the "*" one
+// or DefaultPolicy when none is configured.
+func (s *Service) policyFor(role string) Policy {
+	if p, ok := s.Opts.Policies[role]; ok {
+		return p
+	}
+
+	if p, ok := s.Opts.Policies["*"]; ok {
+		return p
+	}
+
+	return DefaultPolicy
+}
+
+// CheckExt tells if the extension may be uploaded, it is used before
+// the content is known.
+func (p Policy) CheckExt(ext string) error {
+	ext = strings.ToLower(ext)
+
+	if matchExt(p.DenyExt, ext) {
+		return ErrNotAllowed
+	}
+
+	if len(p.AllowExt) > 0 && !matchExt(p.AllowExt, ext) {
+		return ErrNotAllowed
+	}
+
+	return nil
+}
+
+// Check tells if a file with the sniffed mime type and extension
+// may be uploaded.
+func (p Policy) Check(mimeType, ext string) error {
+	if err := p.CheckExt(ext); err != nil {
+		return err
+	}
+
+	if matchMime(p.DenyMime, mimeType) {
+		return ErrNotAllowed
+	}
+
+	if len(p.AllowMime) > 0 && !matchMime(p.AllowMime, mimeType) {
+		return ErrNotAllowed
+	}
+
+	return nil
+}
+
+func matchExt(list []string, ext string) bool {
+	for _, e := range list {
+		if strings.ToLower(e) == ext {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchMime(list []string, mimeType string) bool {
+	for _, m := range list {
+		if m == mimeType ||
+			(strings.HasSuffix(m, "*") && strings.HasPrefix(mimeType, strings.TrimSuffix(m, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sniff detects the mime type of the local file name from its content
+// and checks that it agrees with the extension of the uploaded file.
+func sniff(name, ext string) (string, error) {
+	m, err := mimetype.DetectFile(name)
+	if err != nil {
+		return "", err
+	}
+
+	mimeType, _, _ := mime.ParseMediaType(m.String())
+
+	if !mimeMatchesExt(m, strings.ToLower(ext)) {
+		return mimeType, ErrMimeMismatch
+	}
+
+	return mimeType, nil
+}
+
+func mimeMatchesExt(m *mimetype.MIME, ext string) bool {
+	if ext == "" {
+		return true
+	}
+
+	extType, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext))
+
+	for p := m; p != nil; p = p.Parent() {
+		if p.Extension() == ext || (extType != "" && p.Is(extType)) {
+			return true
+		}
+	}
+
+	// unknown extensions can't contradict the content
+	if extType == "" {
+		return true
+	}
+
+	// plain text is a valid content of any text format (csv, md...)
+	if m.Is("text/plain") && strings.HasPrefix(extType, "text/") && extType != "text/html" {
+		return true
+	}
+
+	return false
+}
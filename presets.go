@@ -0,0 +1,173 @@
+package files
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Preset is a named image size generated for every uploaded image.
+type Preset struct {
+	Name   string
+	Width  int
+	Height int
+	// Crop fills the whole Width x Height box cutting the edges,
+	// otherwise the image is scaled down to fit into the box.
+	Crop bool
+}
+
+// ParsePreset reads a preset declared as "<name> <size> [crop|fit]",
+// size is "150x150", "800w" or "600h", e.g. "thumb 150x150 crop".
+func ParsePreset(s string) (Preset, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return Preset{}, fmt.Errorf("Invalid preset %q", s)
+	}
+
+	p := Preset{Name: fields[0]}
+
+	var err error
+	size := fields[1]
+	switch {
+	case strings.HasSuffix(size, "w"):
+		p.Width, err = strconv.Atoi(strings.TrimSuffix(size, "w"))
+	case strings.HasSuffix(size, "h"):
+		p.Height, err = strconv.Atoi(strings.TrimSuffix(size, "h"))
+	default:
+		wh := strings.SplitN(size, "x", 2)
+		if len(wh) != 2 {
+			return Preset{}, fmt.Errorf("Invalid preset size %q", size)
+		}
+		if p.Width, err = strconv.Atoi(wh[0]); err == nil {
+			p.Height, err = strconv.Atoi(wh[1])
+		}
+	}
+	if err != nil || p.Width < 0 || p.Height < 0 || p.Width+p.Height == 0 {
+		return Preset{}, fmt.Errorf("Invalid preset size %q", size)
+	}
+
+	if len(fields) == 3 {
+		switch fields[2] {
+		case "crop":
+			p.Crop = true
+		case "fit":
+		default:
+			return Preset{}, fmt.Errorf("Invalid preset mode %q", fields[2])
+		}
+	}
+
+	if p.Crop && (p.Width == 0 || p.Height == 0) {
+		return Preset{}, errors.New("Crop preset needs both width and height")
+	}
+
+	return p, nil
+}
+
+// Variant is a resized copy of an image made by a preset.
+type Variant struct {
+	Path   string `json:"path"`
+	Src    string `json:"src"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// Variants maps preset names to the generated images,
+// stored as json in a single column.
+type Variants map[string]Variant
+
+func (v Variants) Value() (driver.Value, error) {
+	if len(v) == 0 {
+		return "", nil
+	}
+
+	return jsonValue(v)
+}
+
+func (v *Variants) Scan(src interface{}) error {
+	*v = nil
+	return jsonScan(src, v)
+}
+
+// makeVariants renders every preset of the image in the local
+// file name and stores them next to the original key.
+func makeVariants(storage Storage, presets []Preset, key, name string, maxPixels int) (Variants, error) {
+	if len(presets) == 0 {
+		return nil, nil
+	}
+
+	ext := path.Ext(key)
+	format, err := imaging.FormatFromExtension(ext)
+	if err != nil {
+		// not an image we can resize
+		return nil, nil
+	}
+
+	img, err := openImage(name, maxPixels)
+	if err != nil {
+		// broken or too large to decode, the original is kept as it is
+		return nil, nil
+	}
+
+	variants := Variants{}
+
+	for _, p := range presets {
+		var out = img
+		b := img.Bounds()
+
+		if p.Crop {
+			out = imaging.Fill(img, p.Width, p.Height, imaging.Center, imaging.Lanczos)
+		} else {
+			w, h := p.Width, p.Height
+			if w == 0 {
+				w = b.Dx()
+			}
+			if h == 0 {
+				h = b.Dy()
+			}
+			if b.Dx() > w || b.Dy() > h {
+				out = imaging.Fit(img, w, h, imaging.Lanczos)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := imaging.Encode(&buf, out, format); err != nil {
+			return variants, err
+		}
+
+		vkey := strings.TrimSuffix(key, ext) + "_" + p.Name + ext
+		if err := storage.Put(vkey, &buf); err != nil {
+			return variants, err
+		}
+
+		variants[p.Name] = Variant{
+			Path:   vkey,
+			Src:    savedURL(storage, vkey),
+			Width:  out.Bounds().Dx(),
+			Height: out.Bounds().Dy(),
+		}
+	}
+
+	return variants, nil
+}
+
+// presetNames lists the presets that produced variants.
+func (v Variants) presetNames(presets []Preset) string {
+	var names []string
+	for _, p := range presets {
+		if _, ok := v[p.Name]; ok {
+			names = append(names, p.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "notset"
+	}
+
+	return strings.Join(names, ",")
+}
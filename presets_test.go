@@ -0,0 +1,100 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParsePreset(t *testing.T) {
+	cases := map[string]Preset{
+		"thumb 150x150 crop": {Name: "thumb", Width: 150, Height: 150, Crop: true},
+		"big 800w":           {Name: "big", Width: 800},
+		"tall 600h fit":      {Name: "tall", Height: 600},
+		" box  320x200 ":     {Name: "box", Width: 320, Height: 200},
+	}
+
+	for s, want := range cases {
+		p, err := ParsePreset(s)
+		if err != nil || p != want {
+			t.Errorf("ParsePreset(%q) = %+v, %v", s, p, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"thumb",
+		"thumb 150x150 crop extra",
+		"thumb 150",
+		"thumb 150x",
+		"thumb x150",
+		"thumb -5w",
+		"thumb 0x0",
+		"thumb 150x150 stretch",
+		"thumb 800w crop",
+		"thumb 600h crop",
+	}
+
+	for _, s := range invalid {
+		if p, err := ParsePreset(s); err == nil {
+			t.Errorf("ParsePreset(%q) must fail: %+v", s, p)
+		}
+	}
+}
+
+func TestVariants(t *testing.T) {
+	s := newTestService(t, WithPresets("thumb 20x20 crop", "wide 40w"))
+
+	pic, err := os.Open("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pic.Close()
+
+	saved, err := s.Save(context.Background(), 1, "a.png", pic, SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for s.runNextJob() {
+	}
+
+	var file File
+	s.App.DB.First(&file, saved.ID)
+
+	if file.Status != StatusReady || file.Preset != "thumb,wide" || len(file.Variants) != 2 {
+		t.Fatalf("Variants not made: %+v", file)
+	}
+
+	sizes := map[string][2]int{"thumb": {20, 20}, "wide": {40, 40}}
+	for name, size := range sizes {
+		v := file.Variants[name]
+		if v.Width != size[0] || v.Height != size[1] || v.Src != "/uploads/"+v.Path {
+			t.Errorf("Wrong %s variant: %+v", name, v)
+		}
+
+		info, err := s.Opts.Storage.Stat(v.Path)
+		if err != nil || info.Size == 0 {
+			t.Errorf("Variant %s not stored: %v", name, err)
+		}
+	}
+
+	data, err := json.Marshal(file.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var public struct {
+		Variants map[string]PublicVariant `json:"variants"`
+	}
+	if err := json.Unmarshal(data, &public); err != nil {
+		t.Fatal(err)
+	}
+
+	thumb := public.Variants["thumb"]
+	if len(public.Variants) != 2 || thumb.Width != 20 || !strings.HasSuffix(thumb.Src, "_thumb.png") {
+		t.Errorf("Wrong variants json: %s", data)
+	}
+}
@@ -0,0 +1,115 @@
+package files
+
+import "time"
+
+// PublicFile is the api representation of a File. Storage keys and server
+// paths stay on the server, clients get the urls in Src and the content
+// endpoints instead.
+type PublicFile struct {
+	ID         uint                     `json:"ID"`
+	CreatedAt  time.Time                `json:"CreatedAt"`
+	UpdatedAt  time.Time                `json:"UpdatedAt"`
+	UserID     int                      `json:"userID"`
+	Name       string                   `json:"name"`
+	Src        string                   `json:"src"`
+	Ext        string                   `json:"ext"`
+	Preset     string                   `json:"preset"`
+	Size       int64                    `json:"size"`
+	Status     int                      `json:"status"`
+	Type       int                      `json:"type"`
+	Hash       string                   `json:"hash"`
+	Variants   map[string]PublicVariant `json:"variants"`
+	Meta       Metadata                 `json:"meta"`
+	Mime       string                   `json:"mime"`
+	Visibility string                   `json:"visibility"`
+	Failure    string                   `json:"failure"`
+}
+
+type PublicVariant struct {
+	Src    string `json:"src"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// PublicAttachment is the api representation of an Attachment.
+type PublicAttachment struct {
+	ID          uint       `json:"ID"`
+	CreatedAt   time.Time  `json:"CreatedAt"`
+	UpdatedAt   time.Time  `json:"UpdatedAt"`
+	UserID      int        `json:"userID"`
+	Group       string     `json:"group"`
+	OwnerType   string     `json:"ownerType"`
+	OwnerID     uint       `json:"ownerID"`
+	FileID      int        `json:"fileID"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	IsMain      int        `json:"isMain"`
+	Index       int        `json:"index"`
+	File        PublicFile `json:"file"`
+}
+
+func (f File) Public() PublicFile {
+	var variants map[string]PublicVariant
+	if len(f.Variants) > 0 {
+		variants = make(map[string]PublicVariant, len(f.Variants))
+		for name, v := range f.Variants {
+			variants[name] = PublicVariant{Src: v.Src, Width: v.Width, Height: v.Height}
+		}
+	}
+
+	return PublicFile{
+		ID:         f.ID,
+		CreatedAt:  f.CreatedAt,
+		UpdatedAt:  f.UpdatedAt,
+		UserID:     f.UserID,
+		Name:       f.Name,
+		Src:        f.Src,
+		Ext:        f.Ext,
+		Preset:     f.Preset,
+		Size:       f.Size,
+		Status:     f.Status,
+		Type:       f.Type,
+		Hash:       f.Hash,
+		Variants:   variants,
+		Meta:       f.Meta,
+		Mime:       f.Mime,
+		Visibility: f.Visibility,
+		Failure:    f.Failure,
+	}
+}
+
+func (files Files) Public() []PublicFile {
+	list := make([]PublicFile, len(files))
+	for i, f := range files {
+		list[i] = f.Public()
+	}
+
+	return list
+}
+
+func (a Attachment) Public() PublicAttachment {
+	return PublicAttachment{
+		ID:          a.ID,
+		CreatedAt:   a.CreatedAt,
+		UpdatedAt:   a.UpdatedAt,
+		UserID:      a.UserID,
+		Group:       a.Group,
+		OwnerType:   a.OwnerType,
+		OwnerID:     a.OwnerID,
+		FileID:      a.FileID,
+		Title:       a.Title,
+		Description: a.Description,
+		IsMain:      a.IsMain,
+		Index:       a.Index,
+		File:        a.File.Public(),
+	}
+}
+
+func (attachments Attachments) Public() []PublicAttachment {
+	list := make([]PublicAttachment, len(attachments))
+	for i, a := range attachments {
+		list[i] = a.Public()
+	}
+
+	return list
+}
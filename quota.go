@@ -0,0 +1,197 @@
+package files
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+var ErrQuotaExceeded = errors.New("Storage quota exceeded")
+
+// Quota limits the storage used by a user, zero values mean no limit.
+type Quota struct {
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int   `json:"maxFiles"`
+}
+
+// UserQuota overrides the role quota of one user, in all services
+// sharing the db.
+type UserQuota struct {
+	gorm.Model
+	UserID   int   `json:"userID" gorm:"unique_index"`
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int   `json:"maxFiles"`
+}
+
+// Usage is the storage consumed by a user, summed from File.Size.
+type Usage struct {
+	UserID   int   `json:"userID"`
+	Files    int   `json:"files"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int   `json:"maxFiles"`
+}
+
+// quotaFor returns the user quota if one is set, the role one otherwise.
+func (s *Service) quotaFor(userID int, role string) Quota {
+	var uq UserQuota
+
+	s.App.DB.Where("user_id = ?", userID).First(&uq)
+	if uq.ID != 0 {
+		return Quota{MaxBytes: uq.MaxBytes, MaxFiles: uq.MaxFiles}
+	}
+
+	return s.Opts.Quotas[role]
+}
+
+// usageOf sums the files of the user, skipping the file with id except.
+func (s *Service) usageOf(userID int, except uint) Usage {
+	usage := Usage{UserID: userID}
+
+	row := s.scoped(s.App.DB).Model(&File{}).
+		Select("count(*), coalesce(sum(size), 0)").
+		Where("user_id = ? AND id <> ?", userID, except).
+		Row()
+	row.Scan(&usage.Files, &usage.Bytes)
+
+	return usage
+}
+
+// reserve adds the resumable uploads of the user still receiving data to
+// the usage, with their full length, so open uploads can not together
+// go over the quota. Uploads being finished become files and count as such.
+func (s *Service) reserve(usage *Usage) {
+	var (
+		uploads int
+		bytes   int64
+	)
+
+	row := s.scoped(s.App.DB).Model(&FileUpload{}).
+		Select("count(*), coalesce(sum(length), 0)").
+		Where("user_id = ? AND file_id = 0 AND received < length", usage.UserID).
+		Row()
+	row.Scan(&uploads, &bytes)
+
+	usage.Files += uploads
+	usage.Bytes += bytes
+}
+
+// quotaLeft returns how many bytes the user may still upload, -1 when
+// there is no limit. The file with id replaced is not counted as it is
+// going to be overwritten.
+func (s *Service) quotaLeft(userID int, role string, replaced uint) (int64, error) {
+	quota := s.quotaFor(userID, role)
+	if quota.MaxBytes == 0 && quota.MaxFiles == 0 {
+		return -1, nil
+	}
+
+	usage := s.usageOf(userID, replaced)
+	s.reserve(&usage)
+
+	if quota.MaxFiles > 0 && usage.Files >= quota.MaxFiles {
+		return 0, ErrQuotaExceeded
+	}
+
+	if quota.MaxBytes == 0 {
+		return -1, nil
+	}
+
+	if usage.Bytes >= quota.MaxBytes {
+		return 0, ErrQuotaExceeded
+	}
+
+	return quota.MaxBytes - usage.Bytes, nil
+}
+
+func (s *Service) actionUsage(w http.ResponseWriter, r *http.Request) {
+	var (
+		usage Usage
+		rsp   = core.Response{Data: &usage, Req: r}
+	)
+
+	userid, _ := strconv.Atoi(r.Header.Get("id"))
+
+	usage = s.usageOf(userid, 0)
+	quota := s.quotaFor(userid, r.Header.Get("role"))
+	usage.MaxBytes = quota.MaxBytes
+	usage.MaxFiles = quota.MaxFiles
+
+	rsp.Data = &usage
+
+	w.Write(rsp.Make())
+}
+
+// actionUsages is the admin view of the usage of all users,
+// only per user quotas are known here.
+func (s *Service) actionUsages(w http.ResponseWriter, r *http.Request) {
+	var (
+		usages []Usage
+		quotas []UserQuota
+		rsp    = core.Response{Data: &usages, Req: r}
+	)
+
+	s.scoped(s.App.DB).Model(&File{}).
+		Select("user_id, count(*) as files, coalesce(sum(size), 0) as bytes").
+		Group("user_id").
+		Order("bytes desc").
+		Scan(&usages)
+
+	s.App.DB.Find(&quotas)
+
+	byUser := map[int]UserQuota{}
+	for _, q := range quotas {
+		byUser[q.UserID] = q
+	}
+
+	for i, u := range usages {
+		if q, ok := byUser[u.UserID]; ok {
+			usages[i].MaxBytes = q.MaxBytes
+			usages[i].MaxFiles = q.MaxFiles
+		}
+	}
+
+	rsp.Data = &usages
+
+	w.Write(rsp.Make())
+}
+
+// actionSetQuota sets the quota of the user from the url,
+// zero limits remove the override.
+func (s *Service) actionSetQuota(w http.ResponseWriter, r *http.Request) {
+	var (
+		data  UserQuota
+		quota UserQuota
+		rsp   = core.Response{Data: &data, Req: r}
+	)
+
+	if rsp.IsJsonParseDone(r.Body) {
+		vars := mux.Vars(r)
+		userid, err := strconv.Atoi(vars["userid"])
+
+		if err != nil || userid == 0 {
+			rsp.Errors.Add("userID", "Invalid user id")
+		} else {
+			s.App.DB.Where("user_id = ?", userid).First(&quota)
+
+			quota.UserID = userid
+			quota.MaxBytes = data.MaxBytes
+			quota.MaxFiles = data.MaxFiles
+
+			if quota.MaxBytes == 0 && quota.MaxFiles == 0 {
+				if quota.ID != 0 {
+					s.App.DB.Unscoped().Delete(&quota)
+				}
+			} else {
+				s.App.DB.Save(&quota)
+			}
+		}
+	}
+
+	rsp.Data = &quota
+
+	w.Write(rsp.Make())
+}
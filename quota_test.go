@@ -0,0 +1,68 @@
+package files
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestQuotaUpload(t *testing.T) {
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, q := range []Quota{{MaxBytes: int64(2*len(pic) - 1)}, {MaxFiles: 1}} {
+		s := newTestService(t, WithQuota("user", q))
+
+		if _, rsp := uploadRequest(t, s.actionUpload, "user", "/files", "a.png", pic); len(rsp.Errors) != 0 {
+			t.Fatalf("Upload within %+v rejected: %+v", q, rsp)
+		}
+
+		w, rsp := uploadRequest(t, s.actionUpload, "user", "/files", "b.png", pic)
+		if len(rsp.Errors) != 1 || !strings.Contains(w.Body.String(), ErrQuotaExceeded.Error()) {
+			t.Errorf("Upload over %+v not rejected: %s", q, w.Body)
+		}
+
+		var count int
+		s.App.DB.Model(&File{}).Count(&count)
+		if count != 1 || storedFiles(t, s) != 1 {
+			t.Errorf("Rejected upload stored: %d rows, %d files", count, storedFiles(t, s))
+		}
+
+		// other roles have no quota
+		if _, rsp := uploadRequest(t, s.actionUpload, "admin", "/files", "c.png", pic); len(rsp.Errors) != 0 {
+			t.Errorf("Admin upload rejected: %+v", rsp)
+		}
+	}
+}
+
+func TestQuotaTusCreate(t *testing.T) {
+	s := newTestService(t, WithQuota("user", Quota{MaxBytes: 100}))
+
+	create := func(length int) int {
+		w := tusRequest(s.actionTusCreate, "POST", "/files/uploads", nil, map[string]string{
+			"role":            "user",
+			"Upload-Length":   fmt.Sprint(length),
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("a.png")),
+		})
+		return w.Code
+	}
+
+	if code := create(101); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Upload over the quota answered %d", code)
+	}
+
+	var uploads int
+	s.App.DB.Model(&FileUpload{}).Count(&uploads)
+	if uploads != 0 {
+		t.Errorf("Rejected upload started: %d", uploads)
+	}
+
+	if code := create(100); code != http.StatusCreated {
+		t.Errorf("Upload within the quota answered %d", code)
+	}
+}
@@ -0,0 +1,297 @@
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/disintegration/imaging"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// sanitizeImage rewrites a JPEG or PNG file in place without its
+// metadata (EXIF, XMP, IPTC, GPS, text chunks). Rotated JPEGs and PNGs
+// with metadata are re-encoded, the pixels rotated by the EXIF
+// orientation, other JPEGs only lose their metadata segments.
+// It reports whether the file was changed.
+func sanitizeImage(name, mimeType string, maxPixels int) (bool, error) {
+	var format imaging.Format
+
+	switch mimeType {
+	case "image/jpeg":
+		if o := jpegOrientation(name); o <= 1 || o > 8 {
+			return stripJPEG(name)
+		}
+		format = imaging.JPEG
+	case "image/png":
+		if !pngHasMetadata(name) {
+			return false, nil
+		}
+		format = imaging.PNG
+	default:
+		return false, nil
+	}
+
+	img, err := openImage(name, maxPixels)
+	if err != nil {
+		return false, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "clean-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = imaging.Encode(tmp, img, format, imaging.JPEGQuality(90))
+	tmp.Close()
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, os.Rename(tmp.Name(), name)
+}
+
+// jpegOrientation reads the EXIF orientation, 0 when there is none.
+func jpegOrientation(name string) int {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		return 0
+	}
+
+	tag, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 0
+	}
+
+	o, _ := tag.Int(0)
+	return o
+}
+
+// keepSegment tells the JPEG segments before the image data that stay:
+// the JFIF header (APP0), ICC color profiles (APP2) and the Adobe color
+// transform (APP14). Other APPn (EXIF, XMP, IPTC...) and comments go,
+// whether their content parses or not.
+func keepSegment(marker byte, data []byte) bool {
+	switch {
+	case marker == 0xe0, marker == 0xee:
+		return true
+	case marker == 0xe2:
+		return bytes.HasPrefix(data, []byte("ICC_PROFILE\x00"))
+	case marker >= 0xe1 && marker <= 0xef, marker == 0xfe:
+		return false
+	}
+
+	return true
+}
+
+// stripJPEG copies the JPEG up to the end of its first image, without
+// its metadata segments. The image data is not decoded so nothing is lost.
+func stripJPEG(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	src := bufio.NewReader(f)
+
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(src, soi); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return false, ErrMimeMismatch
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), "clean-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	dst := bufio.NewWriter(tmp)
+	dst.Write(soi)
+
+	changed := false
+	for {
+		marker, err := nextMarker(src)
+		if err != nil {
+			tmp.Close()
+			return false, err
+		}
+
+		// standalone markers have no length
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			dst.Write([]byte{0xff, marker})
+			continue
+		}
+
+		// the image ends, anything appended after it (MPF pictures,
+		// other images) goes with their own metadata
+		if marker == 0xd9 {
+			dst.Write([]byte{0xff, marker})
+			if _, err := src.Peek(1); err == nil {
+				changed = true
+			}
+			break
+		}
+
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(src, header); err != nil {
+			tmp.Close()
+			return false, ErrMimeMismatch
+		}
+
+		length := int(binary.BigEndian.Uint16(header))
+		if length < 2 {
+			tmp.Close()
+			return false, ErrMimeMismatch
+		}
+
+		data := make([]byte, length-2)
+		if _, err := io.ReadFull(src, data); err != nil {
+			tmp.Close()
+			return false, ErrMimeMismatch
+		}
+
+		if !keepSegment(marker, data) {
+			changed = true
+			continue
+		}
+
+		dst.Write([]byte{0xff, marker})
+		dst.Write(header)
+		dst.Write(data)
+
+		// the image data of the scan follows its header, a truncated
+		// image ends with it
+		if marker == 0xda && copyScan(dst, src) == io.EOF {
+			break
+		}
+	}
+
+	if err := dst.Flush(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	return true, os.Rename(tmp.Name(), name)
+}
+
+// copyScan copies the entropy coded data of a scan, up to the marker
+// after it. Stuffed 0xff bytes and restart markers are part of the data.
+func copyScan(dst io.Writer, src *bufio.Reader) error {
+	for {
+		if _, err := src.Peek(2); err != nil {
+			rest, _ := src.Peek(src.Buffered())
+			dst.Write(rest)
+			return io.EOF
+		}
+
+		buf, _ := src.Peek(src.Buffered())
+
+		i := bytes.IndexByte(buf, 0xff)
+		switch {
+		case i < 0:
+			i = len(buf)
+		case i == 0 && (buf[1] == 0x00 || (buf[1] >= 0xd0 && buf[1] <= 0xd7)):
+			i = 2
+		case i == 0:
+			return nil
+		}
+
+		dst.Write(buf[:i])
+		src.Discard(i)
+	}
+}
+
+// nextMarker reads the next marker code, skipping fill bytes.
+func nextMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, ErrMimeMismatch
+	}
+	if b != 0xff {
+		return 0, ErrMimeMismatch
+	}
+
+	for {
+		b, err = r.ReadByte()
+		if err != nil {
+			return 0, ErrMimeMismatch
+		}
+		if b != 0xff {
+			return b, nil
+		}
+	}
+}
+
+// pngHasMetadata looks for the chunks that may keep metadata.
+func pngHasMetadata(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(f, chunk); err != nil {
+			return false
+		}
+
+		switch string(chunk[4:]) {
+		case "eXIf", "tEXt", "iTXt", "zTXt", "tIME":
+			return true
+		case "IEND":
+			return false
+		}
+
+		// skip the data and the crc
+		length := int64(binary.BigEndian.Uint32(chunk[:4]))
+		if _, err := f.Seek(length+4, io.SeekCurrent); err != nil {
+			return false
+		}
+	}
+}
+
+// hashFile returns the sha256 and the size of the local file.
+func hashFile(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), size, nil
+}
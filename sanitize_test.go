@@ -0,0 +1,198 @@
+package files
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testJPEG encodes a w x h image with the segments inserted after SOI.
+func testJPEG(t *testing.T, w, h int, segments ...[]byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	out := append([]byte{}, buf.Bytes()[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+
+	return append(out, buf.Bytes()[2:]...)
+}
+
+func segment(marker byte, data string) []byte {
+	n := len(data) + 2
+	return append([]byte{0xff, marker, byte(n >> 8), byte(n)}, data...)
+}
+
+// exifSegment is an APP1 EXIF with the camera make and the orientation.
+func exifSegment(camera string, orientation uint16) []byte {
+	var b bytes.Buffer
+	b.WriteString("Exif\x00\x00II*\x00")
+	binary.Write(&b, binary.LittleEndian, uint32(8))
+	binary.Write(&b, binary.LittleEndian, uint16(2))
+	binary.Write(&b, binary.LittleEndian, []uint16{0x10f, 2})
+	binary.Write(&b, binary.LittleEndian, uint32(4))
+	b.WriteString(camera[:3] + "\x00")
+	binary.Write(&b, binary.LittleEndian, []uint16{0x112, 3})
+	binary.Write(&b, binary.LittleEndian, uint32(1))
+	binary.Write(&b, binary.LittleEndian, []uint16{orientation, 0})
+	binary.Write(&b, binary.LittleEndian, uint32(0))
+
+	return segment(0xe1, b.String())
+}
+
+func writeTemp(t *testing.T, data []byte) string {
+	name := filepath.Join(t.TempDir(), "image.jpg")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+func TestStripJPEG(t *testing.T) {
+	plain := testJPEG(t, 20, 10)
+	icc := segment(0xe2, "ICC_PROFILE\x00\x01\x01profile")
+
+	name := writeTemp(t, testJPEG(t, 20, 10,
+		segment(0xe1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>GPSLatitude 48.85</x:xmpmeta>"),
+		segment(0xed, "Photoshop 3.0\x008BIM GPS city"),
+		segment(0xe1, "Exif\x00\x00broken GPS"),
+		segment(0xfe, "GPS comment"),
+		icc,
+	))
+
+	changed, err := sanitizeImage(name, "image/jpeg", 1<<20)
+	if err != nil || !changed {
+		t.Fatalf("Metadata not stripped: %v %v", changed, err)
+	}
+
+	data, _ := ioutil.ReadFile(name)
+
+	if bytes.Contains(data, []byte("GPS")) {
+		t.Error("Metadata left in the image")
+	}
+
+	// the image data is copied as is, the color profile is kept
+	if want := append(append(plain[:2:2], icc...), plain[2:]...); !bytes.Equal(data, want) {
+		t.Error("Image data changed")
+	}
+
+	name = writeTemp(t, plain)
+	if changed, err := sanitizeImage(name, "image/jpeg", 1<<20); err != nil || changed {
+		t.Errorf("Clean image rewritten: %v %v", changed, err)
+	}
+}
+
+func TestStripJPEGAppended(t *testing.T) {
+	plain := testJPEG(t, 20, 10)
+
+	// a second picture, as in MPF files, with its own GPS
+	second := testJPEG(t, 8, 8, segment(0xe1, "Exif\x00\x00GPS 48.85"))
+	name := writeTemp(t, append(append([]byte{}, plain...), second...))
+
+	changed, err := sanitizeImage(name, "image/jpeg", 1<<20)
+	if err != nil || !changed {
+		t.Fatalf("Appended image not stripped: %v %v", changed, err)
+	}
+
+	if data, _ := ioutil.ReadFile(name); !bytes.Equal(data, plain) {
+		t.Errorf("Image not cut at its end: %d bytes, want %d", len(data), len(plain))
+	}
+}
+
+func TestSanitizeRotated(t *testing.T) {
+	name := writeTemp(t, testJPEG(t, 20, 10, exifSegment("Cam", 6)))
+
+	_, kept, err := readMetadata(name)
+	if err != nil || kept.Make != "Cam" {
+		t.Fatalf("Wrong EXIF: %+v %v", kept, err)
+	}
+
+	changed, err := sanitizeImage(name, "image/jpeg", 1<<20)
+	if err != nil || !changed {
+		t.Fatalf("Rotated image not rewritten: %v %v", changed, err)
+	}
+
+	meta, data, _ := readMetadata(name)
+
+	if meta.Width != 10 || meta.Height != 20 || meta.Orientation != 0 || data != (ExifData{}) {
+		t.Errorf("Wrong sanitized image: %+v %+v", meta, data)
+	}
+
+	// the processing keeps what was read on upload on the server only
+	file := File{Exif: kept}
+	if err := metadataTask(&file, name); err != nil {
+		t.Fatal(err)
+	}
+
+	if file.Exif.Make != "Cam" || file.Meta.Make != "" {
+		t.Errorf("Wrong kept metadata: %+v %+v", file.Meta, file.Exif)
+	}
+
+	public, _ := json.Marshal(file.Public())
+	if bytes.Contains(public, []byte("Cam")) {
+		t.Errorf("Kept metadata published: %s", public)
+	}
+}
+
+func TestExifColumn(t *testing.T) {
+	data := ExifData{Make: "Cam", Latitude: 48.85, Longitude: 2.35}
+
+	v, err := data.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var back ExifData
+	if err := back.Scan(v); err != nil || back != data {
+		t.Errorf("Wrong column round trip: %+v %v", back, err)
+	}
+}
+
+// hugePNG is a 1x1 PNG whose header claims w x h pixels.
+func hugePNG(t *testing.T, w, h uint32) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+
+	// signature, IHDR length and type, then width and height
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data[16:], w)
+	binary.BigEndian.PutUint32(data[20:], h)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	return data
+}
+
+func TestOpenImageLimit(t *testing.T) {
+	name := writeTemp(t, hugePNG(t, 100000, 100000))
+
+	if _, err := openImage(name, 50000000); err != ErrImageTooLarge {
+		t.Errorf("Huge image decoded: %v", err)
+	}
+
+	// no storage, it would panic on a Put
+	variants, err := makeVariants(nil, []Preset{{Name: "thumb", Width: 10, Height: 10}}, "a.png", name, 50000000)
+	if err != nil || variants != nil {
+		t.Errorf("Huge image resized: %v %v", variants, err)
+	}
+
+	name = writeTemp(t, testJPEG(t, 20, 10))
+	if img, err := openImage(name, 200); err != nil || img.Bounds().Dx() != 20 {
+		t.Errorf("Image within the limit not decoded: %v", err)
+	}
+	if _, err := openImage(name, 199); err != ErrImageTooLarge {
+		t.Errorf("Image over the limit decoded: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package files
+
+import (
+	"sync"
+
+	"github.com/go-rest-framework/core"
+	"github.com/jinzhu/gorm"
+)
+
+// Service is a files api with its own db, router, storages and options,
+// so an app can mount several of them, e.g. public media on one router
+// and private documents on another. Services sharing a db share the
+// tables, give each of them its own Options.Namespace to keep their
+// rows apart.
+type Service struct {
+	App  core.App
+	Opts Options
+
+	// wake makes idle workers look for jobs right away.
+	wake chan struct{}
+
+	hooksMu sync.RWMutex
+	hooks   map[string][]Hook
+}
+
+// Default is the service set up by Configure and used by
+// the package level functions (Save, Delete, On...).
+var Default = &Service{}
+
+// NewService sets up a service on the db and router of a, the storages
+// and the rest come from the options. Its routes are registered on a.R,
+// use a subrouter to mount it under another prefix.
+func NewService(a core.App, opts ...Option) *Service {
+	s := &Service{}
+	s.init(a, opts...)
+
+	return s
+}
+
+// scoped limits db to the rows of the service in the tables with
+// a Namespace column.
+func (s *Service) scoped(db *gorm.DB) *gorm.DB {
+	return db.Where("namespace = ?", s.Opts.Namespace)
+}
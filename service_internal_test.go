@@ -0,0 +1,83 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestServicesShareDB(t *testing.T) {
+	db := testDB(t)
+
+	// the endpoint is never called, media deliveries are not run
+	media := newTestServiceOn(t, db, WithNamespace("media"), WithWebhook("http://127.0.0.1:1/hook", "secret"))
+	docs := newTestServiceOn(t, db, WithNamespace("docs"))
+
+	save := func(s *Service) File {
+		pic, err := os.Open("test_pic1.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pic.Close()
+
+		file, err := s.Save(context.Background(), 1, "a.png", pic, SaveOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return file
+	}
+
+	fm, fd := save(media), save(docs)
+
+	for docs.runNextJob() {
+	}
+
+	var jobs int
+	db.Model(&FileJob{}).Where("file_id = ?", fm.ID).Count(&jobs)
+	if jobs != 1 {
+		t.Errorf("Job of the other service run: %d left", jobs)
+	}
+
+	var done File
+	db.First(&done, fd.ID)
+	if done.Status != StatusReady {
+		t.Errorf("Own job not run: %+v", done)
+	}
+
+	if docs.runNextDelivery() {
+		t.Error("Delivery of the other service claimed")
+	}
+
+	var deliveries int
+	db.Model(&WebhookDelivery{}).Count(&deliveries)
+	if deliveries != 1 {
+		t.Errorf("Delivery of the other service removed: %d left", deliveries)
+	}
+
+	r := httptest.NewRequest("GET", "/files", nil)
+	r.Header.Set("role", "admin")
+	w := httptest.NewRecorder()
+	docs.actionGetAll(w, r)
+
+	var list struct {
+		Data []PublicFile `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Data) != 1 || list.Data[0].ID != fd.ID {
+		t.Errorf("Files of the other service listed: %s", w.Body.String())
+	}
+
+	if err := docs.Delete(context.Background(), fm.ID); err != ErrNotFound {
+		t.Errorf("File of the other service deleted: %v", err)
+	}
+
+	if err := media.Delete(context.Background(), fm.ID); err != nil {
+		t.Error(err)
+	}
+}
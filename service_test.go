@@ -0,0 +1,164 @@
+package files_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/go-rest-framework/files"
+)
+
+func readPic(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestDedup(t *testing.T) {
+	s := files.NewTestService(t, files.WithDedup())
+	ctx := context.Background()
+	pic := readPic(t, "test_pic1.png")
+
+	a, err := s.Save(ctx, 1, "a.png", bytes.NewReader(pic), files.SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := s.Save(ctx, 2, "b.png", bytes.NewReader(pic), files.SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.ID == b.ID || a.Path != b.Path {
+		t.Fatalf("Same content must share the blob: %s %s", a.Path, b.Path)
+	}
+
+	private, err := s.Save(ctx, 1, "c.png", bytes.NewReader(pic), files.SaveOptions{Visibility: files.VisibilityPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Opts.Storage.Stat(a.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(ctx, a.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Opts.Storage.Stat(a.Path); err != nil {
+		t.Errorf("Blob removed while still used: %v", err)
+	}
+
+	if err := s.Delete(ctx, b.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Opts.Storage.Stat(a.Path); err == nil {
+		t.Error("Blob kept after its last file was deleted")
+	}
+
+	// the private copy is a blob of its own
+	if _, err := s.Opts.PrivateStorage.Stat(private.Path); err != nil {
+		t.Errorf("Private blob removed with the public ones: %v", err)
+	}
+}
+
+func TestSaveDelete(t *testing.T) {
+	s := files.NewTestService(t)
+	ctx := context.Background()
+	pic := readPic(t, "test_pic1.png")
+
+	if _, err := s.Save(ctx, 1, "a.png", bytes.NewReader(pic), files.SaveOptions{Visibility: "hidden"}); err != files.ErrVisibility {
+		t.Errorf("Invalid visibility saved: %v", err)
+	}
+
+	file, err := s.Save(ctx, 1, "a.png", bytes.NewReader(pic), files.SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if file.ID == 0 || file.UserID != 1 || file.Size != int64(len(pic)) || file.Visibility != files.VisibilityPublic {
+		t.Errorf("Wrong saved file: %+v", file)
+	}
+
+	if _, err := s.Opts.Storage.Stat(file.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(ctx, file.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	var left int
+	s.App.DB.Model(&files.File{}).Where("id = ?", file.ID).Count(&left)
+	if left != 0 {
+		t.Error("Record kept after Delete")
+	}
+
+	if _, err := s.Opts.Storage.Stat(file.Path); err == nil {
+		t.Error("Blob kept after Delete")
+	}
+
+	if err := s.Delete(ctx, file.ID); err != files.ErrNotFound {
+		t.Errorf("Missing file deleted: %v", err)
+	}
+}
+
+func TestHookVeto(t *testing.T) {
+	s := files.NewTestService(t)
+	ctx := context.Background()
+	pic := readPic(t, "test_pic1.png")
+	infected := errors.New("Virus found")
+
+	var stored string
+	s.On(files.EventBeforeUpload, func(ctx context.Context, file files.File) error {
+		stored = file.Path
+		return infected
+	})
+
+	var rejected *files.HookError
+	if _, err := s.Save(ctx, 1, "a.png", bytes.NewReader(pic), files.SaveOptions{}); !errors.As(err, &rejected) ||
+		rejected.Event != files.EventBeforeUpload || !errors.Is(err, infected) {
+		t.Fatalf("Upload not rejected by the hook: %v", err)
+	}
+
+	var count int
+	s.App.DB.Model(&files.File{}).Count(&count)
+	if count != 0 {
+		t.Errorf("Rejected upload saved: %d files", count)
+	}
+
+	if _, err := s.Opts.Storage.Stat(stored); stored == "" || err == nil {
+		t.Errorf("Rejected upload kept in the storage: %q", stored)
+	}
+
+	s = files.NewTestService(t)
+
+	var deleted uint
+	s.On(files.EventBeforeDelete, func(ctx context.Context, file files.File) error {
+		return infected
+	})
+	s.On(files.EventDeleted, func(ctx context.Context, file files.File) error {
+		deleted = file.ID
+		return nil
+	})
+
+	file, err := s.Save(ctx, 1, "a.png", bytes.NewReader(pic), files.SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(ctx, file.ID); !errors.As(err, &rejected) || rejected.Event != files.EventBeforeDelete {
+		t.Fatalf("Delete not rejected by the hook: %v", err)
+	}
+
+	if _, err := s.Opts.Storage.Stat(file.Path); err != nil || deleted != 0 {
+		t.Errorf("Rejected delete removed the file: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package files
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage keeps the contents of uploaded files. Keys are slash separated
+// paths relative to the storage root, e.g. "<user>/<date>/photo.png".
+type Storage interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (Object, error)
+	Delete(key string) error
+	Stat(key string) (ObjectInfo, error)
+	URL(key string) string
+}
+
+// FilePutter is implemented by storages that can take over a complete
+// local file more cheaply than copying it, e.g. by renaming it.
+type FilePutter interface {
+	PutFile(key, name string) error
+}
+
+// ExpiringURLs is implemented by storages whose urls stop working after
+// a while, e.g. presigned ones. Their urls are not saved with the file
+// but made again every time it is read.
+type ExpiringURLs interface {
+	URLsExpire() bool
+}
+
+// savedURL is the url to save for key, empty when it would expire.
+func savedURL(storage Storage, key string) string {
+	if e, ok := storage.(ExpiringURLs); ok && e.URLsExpire() {
+		return ""
+	}
+
+	return storage.URL(key)
+}
+
+// Object is an opened blob returned by Storage.Get.
+type Object interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// ObjectInfo describes a stored blob.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+var ErrInvalidKey = errors.New("Invalid storage key")
+
+// LocalStorage stores blobs on the local disk under Root and serves
+// them from BaseURL (usually the uploads dir inside the web root).
+type LocalStorage struct {
+	Root    string
+	BaseURL string
+}
+
+func NewLocalStorage(root, baseURL string) *LocalStorage {
+	return &LocalStorage{
+		Root:    root,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+func (s *LocalStorage) path(key string) (string, error) {
+	// rows created before the storage layer keep absolute paths
+	if filepath.IsAbs(key) && strings.HasPrefix(key, s.Root+string(filepath.Separator)) {
+		return key, nil
+	}
+
+	p := filepath.Join(s.Root, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, s.Root+string(filepath.Separator)) {
+		return "", ErrInvalidKey
+	}
+
+	return p, nil
+}
+
+// Put writes to a temp file next to the target and renames it,
+// so readers never see a partially written blob.
+func (s *LocalStorage) Put(key string, r io.Reader) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+// PutFile renames name into place, falling back to a copy
+// when it is on another device.
+func (s *LocalStorage) PutFile(key, name string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(name, 0644); err == nil {
+		if err := os.Rename(name, p); err == nil {
+			return nil
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.Put(key, f)
+}
+
+func (s *LocalStorage) Get(key string) (Object, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(p)
+}
+
+func (s *LocalStorage) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(p)
+}
+
+func (s *LocalStorage) Stat(key string) (ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Key:     key,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+// URL is empty for storages outside the web root (no BaseURL).
+func (s *LocalStorage) URL(key string) string {
+	if s.BaseURL == "" {
+		return ""
+	}
+
+	return s.BaseURL + "/" + strings.TrimPrefix(key, "/")
+}
@@ -0,0 +1,139 @@
+package files
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config describes a bucket on any S3-compatible server (AWS, MinIO...).
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	UseSSL    bool
+	// PublicURL is the base url of a public bucket or CDN, when empty
+	// File.Src is a presigned url valid for URLExpiry, made on every read.
+	PublicURL string
+	URLExpiry time.Duration
+}
+
+// S3Storage stores blobs as objects in an S3-compatible bucket, so every
+// app replica sees the same files.
+type S3Storage struct {
+	Client    *minio.Client
+	Bucket    string
+	PublicURL string
+	URLExpiry time.Duration
+}
+
+func NewS3Storage(c S3Config) (*S3Storage, error) {
+	client, err := minio.New(c.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(c.AccessKey, c.SecretKey, ""),
+		Secure: c.UseSSL,
+		Region: c.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.URLExpiry == 0 {
+		// the longest expiry allowed by signature v4
+		c.URLExpiry = 7 * 24 * time.Hour
+	}
+
+	return &S3Storage{
+		Client:    client,
+		Bucket:    c.Bucket,
+		PublicURL: strings.TrimSuffix(c.PublicURL, "/"),
+		URLExpiry: c.URLExpiry,
+	}, nil
+}
+
+// unknownSizePart is the multipart chunk of uploads of unknown size,
+// objects can have up to 10000 parts so they are limited to ~160 GiB.
+const unknownSizePart = 16 << 20
+
+func (s *S3Storage) Put(key string, r io.Reader) error {
+	var size int64 = -1
+	if l, ok := r.(interface{ Len() int }); ok {
+		size = int64(l.Len())
+	} else if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+
+	var opts minio.PutObjectOptions
+	if size < 0 {
+		// minio buffers a whole part per upload, the default for
+		// unknown sizes is over 500 MiB
+		opts.PartSize = unknownSizePart
+	}
+
+	_, err := s.Client.PutObject(context.Background(), s.Bucket, key, r, size, opts)
+
+	return err
+}
+
+func (s *S3Storage) Get(key string) (Object, error) {
+	obj, err := s.Client.GetObject(
+		context.Background(), s.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject is lazy, stat it so missing keys fail here
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func (s *S3Storage) Delete(key string) error {
+	return s.Client.RemoveObject(
+		context.Background(), s.Bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3Storage) Stat(key string) (ObjectInfo, error) {
+	info, err := s.Client.StatObject(
+		context.Background(), s.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return ObjectInfo{
+		Key:     key,
+		Size:    info.Size,
+		ModTime: info.LastModified,
+	}, nil
+}
+
+func (s *S3Storage) URL(key string) string {
+	if s.PublicURL != "" {
+		return s.PublicURL + "/" + key
+	}
+
+	u, err := s.Client.PresignedGetObject(
+		context.Background(), s.Bucket, key, s.URLExpiry, nil)
+	if err != nil {
+		return ""
+	}
+
+	return u.String()
+}
+
+// URLsExpire reports whether URL presigns, which it does
+// without a PublicURL.
+func (s *S3Storage) URLsExpire() bool {
+	return s.PublicURL == ""
+}
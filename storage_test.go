@@ -0,0 +1,90 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStorageKeys(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	s := NewLocalStorage(root, "/uploads/")
+
+	cases := []struct {
+		key  string
+		path string
+		err  error
+	}{
+		{"a/b.png", filepath.Join(root, "a", "b.png"), nil},
+		{"a/../b.png", filepath.Join(root, "b.png"), nil},
+		{"../b.png", "", ErrInvalidKey},
+		{"a/../../b.png", "", ErrInvalidKey},
+		{"../root-other/b.png", "", ErrInvalidKey},
+		{"..", "", ErrInvalidKey},
+		{"", "", ErrInvalidKey},
+		// absolute keys stay inside the root, old rows keep theirs
+		{"/etc/passwd", filepath.Join(root, "etc", "passwd"), nil},
+		{"/../../etc/passwd", "", ErrInvalidKey},
+		{filepath.Join(root, "a", "b.png"), filepath.Join(root, "a", "b.png"), nil},
+	}
+
+	for _, c := range cases {
+		p, err := s.path(c.key)
+		if err != c.err || p != c.path {
+			t.Errorf("path(%q) = %q, %v; want %q, %v", c.key, p, err, c.path, c.err)
+		}
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir := t.TempDir()
+	s := NewLocalStorage(filepath.Join(dir, "root"), "/uploads/")
+
+	if err := s.Put("a/b.txt", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.Stat("a/b.txt")
+	if err != nil || info.Size != 5 {
+		t.Fatalf("Wrong stat: %+v %v", info, err)
+	}
+
+	obj, err := s.Get("a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(obj)
+	obj.Close()
+	if err != nil || string(data) != "hello" {
+		t.Errorf("Wrong content: %q %v", data, err)
+	}
+
+	if u := s.URL("a/b.txt"); u != "/uploads/a/b.txt" {
+		t.Errorf("Wrong url: %s", u)
+	}
+
+	if err := s.Delete("a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("a/b.txt"); !os.IsNotExist(err) {
+		t.Errorf("Deleted blob still readable: %v", err)
+	}
+
+	for _, key := range []string{"../escaped.txt", "a/../../escaped.txt"} {
+		if err := s.Put(key, strings.NewReader("x")); err != ErrInvalidKey {
+			t.Errorf("Put(%q): %v", key, err)
+		}
+		if _, err := s.Get(key); err != ErrInvalidKey {
+			t.Errorf("Get(%q): %v", key, err)
+		}
+		if err := s.Delete(key); err != ErrInvalidKey {
+			t.Errorf("Delete(%q): %v", key, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); !os.IsNotExist(err) {
+		t.Error("Blob written outside the root")
+	}
+}
@@ -0,0 +1,352 @@
+package files
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+var ErrTransform = errors.New("Invalid image transform")
+
+const (
+	FitContain = "contain"
+	FitCover   = "cover"
+)
+
+// Transform is a resize of an image made on request by
+// GET /files/{id}/image, e.g. ?w=320&h=240&fit=cover&format=jpeg&q=80.
+type Transform struct {
+	Width  int
+	Height int
+	// Fit is FitContain (scale down into the box, the default)
+	// or FitCover (fill the whole box cutting the edges)
+	Fit string
+	// Format is "jpeg", "png" or "gif", empty keeps the original one
+	Format  string
+	Quality int
+}
+
+// Derivative is a cached result of a transform, kept to be
+// removed with the last file of the same content.
+type Derivative struct {
+	gorm.Model
+	Hash       string `gorm:"index"`
+	Visibility string `gorm:"type:varchar(10)"`
+	Path       string `gorm:"unique_index:idx_derivative_path"`
+	Namespace  string `json:"-" gorm:"type:varchar(100);not null;default:'';index;unique_index:idx_derivative_path"`
+}
+
+var transformFormats = map[string]imaging.Format{
+	"jpeg": imaging.JPEG,
+	"png":  imaging.PNG,
+	"gif":  imaging.GIF,
+}
+
+// ParseTransform reads and validates the transform params of the query
+// with the limits of the Default service.
+func ParseTransform(q url.Values) (Transform, error) {
+	return Default.ParseTransform(q)
+}
+
+// ParseTransform reads and validates the transform params of the query.
+func (s *Service) ParseTransform(q url.Values) (Transform, error) {
+	var (
+		t   Transform
+		err error
+	)
+
+	if v := q.Get("w"); v != "" {
+		if t.Width, err = strconv.Atoi(v); err != nil {
+			return t, ErrTransform
+		}
+	}
+	if v := q.Get("h"); v != "" {
+		if t.Height, err = strconv.Atoi(v); err != nil {
+			return t, ErrTransform
+		}
+	}
+	if v := q.Get("q"); v != "" {
+		if t.Quality, err = strconv.Atoi(v); err != nil {
+			return t, ErrTransform
+		}
+	}
+
+	t.Fit = q.Get("fit")
+	t.Format = q.Get("format")
+
+	return t, t.validate(s.Opts.MaxTransformSize)
+}
+
+func (t Transform) validate(maxSize int) error {
+	if t.Width < 0 || t.Height < 0 || t.Width+t.Height == 0 ||
+		t.Width > maxSize || t.Height > maxSize {
+		return ErrTransform
+	}
+
+	if t.Quality < 0 || t.Quality > 100 {
+		return ErrTransform
+	}
+
+	switch t.Fit {
+	case "", FitContain:
+	case FitCover:
+		if t.Width == 0 || t.Height == 0 {
+			return ErrTransform
+		}
+	default:
+		return ErrTransform
+	}
+
+	if _, ok := transformFormats[t.Format]; t.Format != "" && !ok {
+		return ErrTransform
+	}
+
+	return nil
+}
+
+// query is the canonical form of the transform, the same params
+// always give the same string to sign and to cache by.
+func (t Transform) query() string {
+	q := url.Values{}
+
+	if t.Width > 0 {
+		q.Set("w", strconv.Itoa(t.Width))
+	}
+	if t.Height > 0 {
+		q.Set("h", strconv.Itoa(t.Height))
+	}
+	if t.Fit != "" && t.Fit != FitContain {
+		q.Set("fit", t.Fit)
+	}
+	if t.Format != "" {
+		q.Set("format", t.Format)
+	}
+	if t.Quality > 0 {
+		q.Set("q", strconv.Itoa(t.Quality))
+	}
+
+	return q.Encode()
+}
+
+// signTransform signs the content hash with the params, a replaced
+// content gets new urls and the old ones, cached as immutable, stop working.
+func (s *Service) signTransform(file File, t Transform) string {
+	mac := hmac.New(sha256.New, s.Opts.SigningKey)
+	fmt.Fprintf(mac, "%d:%s:%s", file.ID, file.Hash, t.query())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignTransform returns the signed query of the transform of
+// the file with the key of the Default service.
+func SignTransform(file File, t Transform) string {
+	return Default.SignTransform(file, t)
+}
+
+// SignTransform returns the signed query of the transform of
+// the file, to be added to /files/{id}/image. It is valid until the
+// content of the file is replaced.
+func (s *Service) SignTransform(file File, t Transform) string {
+	return t.query() + "&s=" + s.signTransform(file, t)
+}
+
+// derivativeKey keys the cached transform by the content hash, so
+// reuploads never serve stale images and equal files share the cache.
+func derivativeKey(file File, t Transform, ext string) string {
+	name := strings.NewReplacer("=", "", "&", "_").Replace(t.query())
+	return "cache/" + file.Hash[:2] + "/" + file.Hash + "/" + name + ext
+}
+
+func (t Transform) ext(file File) (string, imaging.Format, error) {
+	if f, ok := transformFormats[t.Format]; ok {
+		if t.Format == "jpeg" {
+			return ".jpg", f, nil
+		}
+		return "." + t.Format, f, nil
+	}
+
+	ext := strings.ToLower(file.Ext)
+	f, err := imaging.FormatFromExtension(ext)
+	return ext, f, err
+}
+
+func (t Transform) apply(img image.Image) image.Image {
+	b := img.Bounds()
+
+	switch {
+	case t.Fit == FitCover:
+		return imaging.Fill(img, t.Width, t.Height, imaging.Center, imaging.Lanczos)
+	case t.Width == 0 || t.Height == 0:
+		if (t.Width > 0 && b.Dx() > t.Width) || (t.Height > 0 && b.Dy() > t.Height) {
+			return imaging.Resize(img, t.Width, t.Height, imaging.Lanczos)
+		}
+	case b.Dx() > t.Width || b.Dy() > t.Height:
+		return imaging.Fit(img, t.Width, t.Height, imaging.Lanczos)
+	}
+
+	return img
+}
+
+// actionImage serves a transformed copy of the image, rendering it once
+// and caching it in the storage of the file. The params must be signed
+// by the server, so nobody can make it render endless sizes.
+func (s *Service) actionImage(w http.ResponseWriter, r *http.Request) {
+	var file File
+
+	vars := mux.Vars(r)
+	s.scoped(s.App.DB).First(&file, vars["id"])
+
+	if file.ID == 0 || !(canRead(r, file) || s.validSignature(r, file)) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if file.Type != TypeImage || file.Hash == "" {
+		http.Error(w, "File is not an image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	t, err := s.ParseTransform(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !hmac.Equal([]byte(r.FormValue("s")), []byte(s.signTransform(file, t))) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+
+	ext, format, err := t.ext(file)
+	if err != nil {
+		http.Error(w, "File is not an image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	storage := s.storageOf(file)
+	key := derivativeKey(file, t, ext)
+
+	w.Header().Set("ETag", `"`+file.Hash+"-"+t.query()+`"`)
+	if file.Visibility == VisibilityPrivate {
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+
+	if obj, err := storage.Get(key); err == nil {
+		defer obj.Close()
+		http.ServeContent(w, r, file.Name+ext, file.UpdatedAt, obj)
+		return
+	}
+
+	name, err := s.localCopy(file)
+	if err != nil {
+		http.Error(w, "File content not found", http.StatusNotFound)
+		return
+	}
+	defer os.Remove(name)
+
+	img, err := openImage(name, s.Opts.MaxImagePixels)
+	if err == ErrImageTooLarge {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, "File is not an image", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	quality := t.Quality
+	if quality == 0 {
+		quality = 90
+	}
+
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, t.apply(img), format, imaging.JPEGQuality(quality)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// a failed cache write only costs a render next time
+	if err := storage.Put(key, bytes.NewReader(buf.Bytes())); err == nil {
+		s.scoped(s.App.DB).Where(Derivative{Path: key}).
+			Attrs(Derivative{Hash: file.Hash, Visibility: file.Visibility, Namespace: s.Opts.Namespace}).
+			FirstOrCreate(&Derivative{})
+	}
+
+	http.ServeContent(w, r, file.Name+ext, file.UpdatedAt, bytes.NewReader(buf.Bytes()))
+}
+
+type ImageLink struct {
+	URL string `json:"url"`
+}
+
+// actionSignImage returns the signed url of a transform of the image,
+// only the owner may mint them.
+func (s *Service) actionSignImage(w http.ResponseWriter, r *http.Request) {
+	var (
+		file File
+		link ImageLink
+		rsp  = core.Response{Data: &link, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	s.scoped(s.App.DB).First(&file, vars["id"])
+
+	if file.ID == 0 {
+		rsp.Errors.Add("ID", "File not found")
+	} else {
+		role := r.Header.Get("role")
+		idstring := fmt.Sprintf("%d", file.UserID)
+		userid := r.Header.Get("id")
+		if role == "admin" || (role == "user" && idstring == userid) {
+			t, err := s.ParseTransform(r.URL.Query())
+			if err != nil {
+				rsp.Errors.Add("Transform", err.Error())
+			} else {
+				link.URL = r.URL.Path + "?" + s.SignTransform(file, t)
+			}
+		} else {
+			rsp.Errors.Add("ID", "Only owner can sign image urls")
+		}
+	}
+
+	w.Write(rsp.Make())
+}
+
+// removeDerivatives deletes the cached transforms of the file content,
+// unless another file still has the same one.
+func (s *Service) removeDerivatives(file File) {
+	if file.Hash == "" {
+		return
+	}
+
+	var refs int
+	s.scoped(s.App.DB).Model(&File{}).
+		Where("hash = ? AND visibility = ? AND id <> ?", file.Hash, file.Visibility, file.ID).
+		Count(&refs)
+	if refs > 0 {
+		return
+	}
+
+	var derivatives []Derivative
+	s.scoped(s.App.DB).Where("hash = ? AND visibility = ?", file.Hash, file.Visibility).Find(&derivatives)
+
+	for _, d := range derivatives {
+		s.storageOf(file).Delete(d.Path)
+		s.App.DB.Unscoped().Delete(&d)
+	}
+}
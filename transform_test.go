@@ -0,0 +1,99 @@
+package files
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTransformSignedContent(t *testing.T) {
+	s := newTestService(t, WithSigningKey([]byte("key")))
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, rsp := uploadRequest(t, s.actionUpload, "user", "/files", "a.png", pic)
+	if len(rsp.Errors) != 0 {
+		t.Fatalf("Upload failed: %+v", rsp)
+	}
+
+	var file File
+	s.App.DB.First(&file, rsp.Data.ID)
+	url := fmt.Sprintf("/files/%d/image?%s", file.ID, s.SignTransform(file, Transform{Width: 10}))
+
+	image := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", url, nil)
+		r.Header.Set("id", "1")
+		r.Header.Set("role", "user")
+		r = mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(file.ID)})
+
+		w := httptest.NewRecorder()
+		s.actionImage(w, r)
+
+		return w
+	}
+
+	if w := image(); w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "public, max-age=31536000, immutable" {
+		t.Fatalf("Signed image not served: %d %v", w.Code, w.Header())
+	}
+
+	// the cached urls must not serve the new content
+	pic, err = ioutil.ReadFile("test_pic2.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, rsp := uploadRequest(t, s.actionReUpload, "user", fmt.Sprintf("/files/%d", file.ID), "b.png", pic); len(rsp.Errors) != 0 {
+		t.Fatalf("Re-upload failed: %+v", rsp)
+	}
+
+	if w := image(); w.Code != http.StatusForbidden {
+		t.Errorf("Url of the old content answered %d", w.Code)
+	}
+}
+
+func TestDerivativeNamespaces(t *testing.T) {
+	db := testDB(t)
+
+	// the unique path of older versions is dropped on start
+	db.AutoMigrate(&Derivative{})
+	db.Model(&Derivative{}).AddUniqueIndex("uix_derivatives_path", "path")
+
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ns := range []string{"media", "docs"} {
+		s := newTestServiceOn(t, db, WithNamespace(ns))
+
+		_, rsp := uploadRequest(t, s.actionUpload, "user", "/files", "a.png", pic)
+		if len(rsp.Errors) != 0 {
+			t.Fatalf("Upload failed: %+v", rsp)
+		}
+
+		var file File
+		s.App.DB.First(&file, rsp.Data.ID)
+
+		r := httptest.NewRequest("GET", "/files/image?"+s.SignTransform(file, Transform{Width: 10}), nil)
+		r.Header.Set("id", "1")
+		r.Header.Set("role", "user")
+		r = mux.SetURLVars(r, map[string]string{"id": fmt.Sprint(file.ID)})
+
+		w := httptest.NewRecorder()
+		s.actionImage(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Image of %s not served: %d", ns, w.Code)
+		}
+
+		var count int
+		s.scoped(db).Model(&Derivative{}).Count(&count)
+		if count != 1 {
+			t.Errorf("Derivative of %s not kept: %d", ns, count)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package files
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// Resumable uploads implementing the core of the tus protocol
+// (https://tus.io/protocols/resumable-upload) with the creation extension.
+// Every PATCH is kept as a separate part in the private storage, when the
+// last byte arrives the parts are joined into a regular File. Uploads not
+// finished within UploadExpiry after their last PATCH are removed.
+
+const tusVersion = "1.0.0"
+
+type FileUpload struct {
+	gorm.Model
+	UserID     int    `json:"userID"`
+	Name       string `json:"name"`
+	Length     int64  `json:"length"`
+	Received   int64  `json:"received"`
+	FileID     uint   `json:"fileID"`
+	Visibility string `json:"visibility" gorm:"type:varchar(10)"`
+	Namespace  string `json:"-" gorm:"type:varchar(100);not null;default:'';index"`
+}
+
+type FileUploadPart struct {
+	gorm.Model
+	FileUploadID uint
+	Start        int64
+	Size         int64
+	Key          string
+}
+
+func (s *Service) actionTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,expiration")
+	if s.Opts.MaxUploadSize > 0 {
+		w.Header().Set("Tus-Max-Size", fmt.Sprintf("%d", s.Opts.MaxUploadSize))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) actionTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	if s.Opts.MaxUploadSize > 0 && length > s.Opts.MaxUploadSize {
+		http.Error(w, ErrFileTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if meta["filename"] == "" {
+		http.Error(w, "Upload-Metadata must contain filename", http.StatusBadRequest)
+		return
+	}
+
+	visibility := meta["visibility"]
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+
+	if visibility != VisibilityPublic && visibility != VisibilityPrivate {
+		http.Error(w, ErrVisibility.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the extension the finished upload is stored with
+	_, ext := splitName(meta["filename"])
+	if err := s.policyFor(r.Header.Get("role")).CheckExt(ext); err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	userid, _ := strconv.Atoi(r.Header.Get("id"))
+
+	remaining, err := s.quotaLeft(userid, r.Header.Get("role"), 0)
+	if err != nil || (remaining >= 0 && length > remaining) {
+		http.Error(w, ErrQuotaExceeded.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	upload := FileUpload{
+		UserID:     userid,
+		Name:       meta["filename"],
+		Length:     length,
+		Visibility: visibility,
+		Namespace:  s.Opts.Namespace,
+	}
+
+	s.App.DB.Create(&upload)
+
+	if length == 0 {
+		if err := s.finishUpload(r.Context(), &upload, r.Header.Get("role")); err != nil {
+			http.Error(w, err.Error(), finishStatus(err))
+			return
+		}
+		w.Header().Set("X-File-ID", fmt.Sprintf("%d", upload.FileID))
+	}
+
+	s.expires(w, upload)
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", strings.TrimSuffix(r.URL.Path, "/"), upload.ID))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Service) actionTusHead(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	upload, ok := s.findUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", fmt.Sprintf("%d", upload.Received))
+	w.Header().Set("Upload-Length", fmt.Sprintf("%d", upload.Length))
+	s.expires(w, upload)
+	if upload.FileID != 0 {
+		w.Header().Set("X-File-ID", fmt.Sprintf("%d", upload.FileID))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Service) actionTusPatch(w http.ResponseWriter, r *http.Request) {
+	if !tusResumable(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	upload, ok := s.findUpload(w, r)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.Received {
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	if upload.Received < upload.Length {
+		key := fmt.Sprintf("tus/%d/%d-%d", upload.ID, offset, time.Now().UnixNano())
+		cut := &cutReader{r: io.LimitReader(r.Body, upload.Length-offset)}
+		body := &countingReader{r: cut}
+
+		if err := s.Opts.PrivateStorage.Put(key, body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if body.n == 0 {
+			s.Opts.PrivateStorage.Delete(key)
+		} else {
+			// a concurrent PATCH with the same offset could win the race
+			res := s.App.DB.Model(&upload).
+				Where("received = ?", offset).
+				Update("received", offset+body.n)
+			if res.RowsAffected == 0 {
+				s.Opts.PrivateStorage.Delete(key)
+				http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+				return
+			}
+
+			s.App.DB.Create(&FileUploadPart{
+				FileUploadID: upload.ID,
+				Start:        offset,
+				Size:         body.n,
+				Key:          key,
+			})
+
+			upload.Received = offset + body.n
+			upload.UpdatedAt = time.Now()
+		}
+
+		if cut.err != nil {
+			// the client resumes from the bytes kept, see HEAD
+			http.Error(w, cut.err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if upload.Received == upload.Length && upload.FileID == 0 {
+		if err := s.finishUpload(r.Context(), &upload, r.Header.Get("role")); err != nil {
+			http.Error(w, err.Error(), finishStatus(err))
+			return
+		}
+	}
+
+	if upload.FileID != 0 {
+		w.Header().Set("X-File-ID", fmt.Sprintf("%d", upload.FileID))
+	}
+	w.Header().Set("Upload-Offset", fmt.Sprintf("%d", upload.Received))
+	s.expires(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+
+	return true
+}
+
+func (s *Service) findUpload(w http.ResponseWriter, r *http.Request) (FileUpload, bool) {
+	var upload FileUpload
+
+	vars := mux.Vars(r)
+	s.scoped(s.App.DB).First(&upload, vars["id"])
+
+	if upload.ID == 0 || s.expired(upload) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return upload, false
+	}
+
+	role := r.Header.Get("role")
+	idstring := fmt.Sprintf("%d", upload.UserID)
+	userid := r.Header.Get("id")
+	if !(role == "admin" || (role == "user" && idstring == userid)) {
+		http.Error(w, "Only owner can change upload", http.StatusForbidden)
+		return upload, false
+	}
+
+	return upload, true
+}
+
+// finishUpload joins the stored parts into a new File and removes them.
+// A rejected upload is removed with its parts, it can not be finished
+// by sending it again. After other errors the parts are kept, an empty
+// PATCH at the end of the upload tries again.
+func (s *Service) finishUpload(ctx context.Context, upload *FileUpload, role string) error {
+	var parts []FileUploadPart
+
+	s.App.DB.Where("file_upload_id = ?", upload.ID).Order("start").Find(&parts)
+
+	src := &partsReader{storage: s.Opts.PrivateStorage, parts: parts}
+	defer src.Close()
+
+	filemodel, err := s.store(File{
+		UserID:     upload.UserID,
+		Visibility: upload.Visibility,
+	}, role, upload.Name, src)
+	if err == nil {
+		filemodel, err = s.insert(ctx, filemodel)
+	}
+
+	if err != nil {
+		if finishStatus(err) != http.StatusInternalServerError {
+			s.removeUpload(*upload)
+		}
+		return err
+	}
+
+	upload.FileID = filemodel.ID
+	s.App.DB.Model(upload).Update("file_id", filemodel.ID)
+
+	s.removeParts(*upload)
+
+	return nil
+}
+
+// removeParts deletes the stored parts of the upload.
+func (s *Service) removeParts(upload FileUpload) {
+	var parts []FileUploadPart
+
+	s.App.DB.Where("file_upload_id = ?", upload.ID).Find(&parts)
+
+	for _, part := range parts {
+		s.Opts.PrivateStorage.Delete(part.Key)
+	}
+	s.App.DB.Unscoped().Where("file_upload_id = ?", upload.ID).Delete(FileUploadPart{})
+}
+
+// removeUpload deletes the upload with its parts.
+func (s *Service) removeUpload(upload FileUpload) {
+	s.removeParts(upload)
+	s.App.DB.Unscoped().Delete(&upload)
+}
+
+func (s *Service) expired(upload FileUpload) bool {
+	return upload.FileID == 0 && time.Since(upload.UpdatedAt) > s.Opts.UploadExpiry
+}
+
+// expires sets the Upload-Expires header of an unfinished upload.
+func (s *Service) expires(w http.ResponseWriter, upload FileUpload) {
+	if upload.FileID == 0 {
+		w.Header().Set("Upload-Expires",
+			upload.UpdatedAt.Add(s.Opts.UploadExpiry).UTC().Format(http.TimeFormat))
+	}
+}
+
+// removeExpiredUploads deletes the uploads not touched for UploadExpiry,
+// unfinished ones with their parts. It reports false when there were none.
+func (s *Service) removeExpiredUploads() bool {
+	var uploads []FileUpload
+
+	s.scoped(s.App.DB).
+		Where("updated_at < ?", time.Now().Add(-s.Opts.UploadExpiry)).
+		Limit(100).
+		Find(&uploads)
+
+	for _, upload := range uploads {
+		s.removeUpload(upload)
+	}
+
+	return len(uploads) > 0
+}
+
+// finishStatus maps the errors of finishUpload to the statuses
+// actionTusCreate uses for the same checks.
+func finishStatus(err error) int {
+	var rejected *HookError
+	switch {
+	case errors.As(err, &rejected):
+		return http.StatusForbidden
+	case err == ErrFileTooLarge || err == ErrQuotaExceeded || err == ErrImageTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case err == ErrNotAllowed || err == ErrMimeMismatch:
+		return http.StatusUnsupportedMediaType
+	}
+
+	return http.StatusInternalServerError
+}
+
+// cutReader ends the stream at the first read error and keeps it in err,
+// so the bytes received before a dropped connection are stored.
+type cutReader struct {
+	r   io.Reader
+	err error
+}
+
+func (c *cutReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if err != nil && err != io.EOF {
+		c.err = err
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// partsReader reads the upload parts one after another,
+// opening only one of them at a time.
+type partsReader struct {
+	storage Storage
+	parts   []FileUploadPart
+	cur     Object
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.cur == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+
+			obj, err := p.storage.Get(p.parts[0].Key)
+			if err != nil {
+				return 0, err
+			}
+
+			p.cur = obj
+			p.parts = p.parts[1:]
+		}
+
+		n, err := p.cur.Read(b)
+		if err == io.EOF {
+			p.cur.Close()
+			p.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() error {
+	if p.cur != nil {
+		return p.cur.Close()
+	}
+
+	return nil
+}
+
+// parseTusMetadata decodes the Upload-Metadata header,
+// a comma separated list of "key base64(value)" pairs.
+func parseTusMetadata(header string) map[string]string {
+	meta := map[string]string{}
+
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		if len(kv) == 0 {
+			continue
+		}
+
+		value := ""
+		if len(kv) > 1 {
+			b, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				continue
+			}
+			value = string(b)
+		}
+
+		meta[kv[0]] = value
+	}
+
+	return meta
+}
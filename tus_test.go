@@ -0,0 +1,131 @@
+package files
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// tusRequest calls the tus action as the admin, with the upload id
+// taken from the last element of url.
+func tusRequest(action http.HandlerFunc, method, url string, body io.Reader, hdr map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, body)
+	r.Header.Set("Tus-Resumable", tusVersion)
+	r.Header.Set("id", "1")
+	r.Header.Set("role", "admin")
+	for k, v := range hdr {
+		r.Header.Set(k, v)
+	}
+	r = mux.SetURLVars(r, map[string]string{"id": path.Base(url)})
+
+	w := httptest.NewRecorder()
+	action(w, r)
+
+	return w
+}
+
+// tusCreate starts an upload of length bytes and returns its url.
+func tusCreate(t *testing.T, s *Service, length int) string {
+	w := tusRequest(s.actionTusCreate, "POST", "/files/uploads", nil, map[string]string{
+		"Upload-Length":   fmt.Sprint(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("a.png")),
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Upload not created: %d %s", w.Code, w.Body)
+	}
+
+	return w.Header().Get("Location")
+}
+
+// brokenReader returns its data, then fails like a dropped connection.
+type brokenReader struct {
+	data []byte
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	if len(b.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+
+	return n, nil
+}
+
+// failingStorage fails every Put.
+type failingStorage struct {
+	Storage
+}
+
+func (failingStorage) Put(key string, r io.Reader) error {
+	return errors.New("Storage unavailable")
+}
+
+func TestTusResume(t *testing.T) {
+	s := newTestService(t)
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := tusCreate(t, s, len(pic))
+	patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+
+	w := tusRequest(s.actionTusPatch, "PATCH", url, &brokenReader{pic[:100]}, patch)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Dropped PATCH answered %d", w.Code)
+	}
+
+	w = tusRequest(s.actionTusHead, "HEAD", url, nil, nil)
+	if w.Header().Get("Upload-Offset") != "100" {
+		t.Fatalf("Received bytes not kept: offset %q", w.Header().Get("Upload-Offset"))
+	}
+
+	// a failing storage must not lose the upload, the client retries
+	public := s.Opts.Storage
+	s.Opts.Storage = failingStorage{public}
+
+	patch["Upload-Offset"] = "100"
+	w = tusRequest(s.actionTusPatch, "PATCH", url, bytes.NewReader(pic[100:]), patch)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Failed finish answered %d", w.Code)
+	}
+
+	s.Opts.Storage = public
+
+	patch["Upload-Offset"] = fmt.Sprint(len(pic))
+	w = tusRequest(s.actionTusPatch, "PATCH", url, nil, patch)
+	if w.Code != http.StatusNoContent || w.Header().Get("X-File-ID") == "" {
+		t.Fatalf("Retried finish failed: %d %s", w.Code, w.Body)
+	}
+
+	var file File
+	s.App.DB.First(&file, w.Header().Get("X-File-ID"))
+	if file.Size != int64(len(pic)) {
+		t.Errorf("Wrong finished file: %+v", file)
+	}
+}
+
+func TestTusCreateExt(t *testing.T) {
+	s := newTestService(t)
+
+	for _, name := range []string{"x.php", "x.php.", "x.PHP ", "dir/x.php"} {
+		w := tusRequest(s.actionTusCreate, "POST", "/files/uploads", nil, map[string]string{
+			"Upload-Length":   "10",
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(name)),
+		})
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%q accepted: %d", name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package files
+
+import (
+	"strconv"
+	"strings"
+)
+
+// File.Type values, classified from the sniffed mime type.
+const (
+	TypeOther = iota
+	TypeImage
+	TypeVideo
+	TypeAudio
+	TypeDocument
+	TypeArchive
+)
+
+// TypeNames are the names accepted by the type filter of the list.
+var TypeNames = map[string]int{
+	"other":    TypeOther,
+	"image":    TypeImage,
+	"video":    TypeVideo,
+	"audio":    TypeAudio,
+	"document": TypeDocument,
+	"archive":  TypeArchive,
+}
+
+var archiveMimes = []string{
+	"application/zip",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/vnd.rar",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-tar",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+}
+
+var documentMimes = []string{
+	"application/pdf",
+	"application/rtf",
+	"text/rtf",
+	"application/msword",
+	"application/epub+zip",
+	"application/vnd.openxmlformats-officedocument.*",
+	"application/vnd.oasis.opendocument.*",
+	"application/vnd.ms-*",
+	"text/*",
+}
+
+func classify(mimeType string) int {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return TypeImage
+	case strings.HasPrefix(mimeType, "video/"):
+		return TypeVideo
+	case strings.HasPrefix(mimeType, "audio/"):
+		return TypeAudio
+	case matchMime(documentMimes, mimeType):
+		return TypeDocument
+	case matchMime(archiveMimes, mimeType):
+		return TypeArchive
+	}
+
+	return TypeOther
+}
+
+// parseTypes reads the type filter, a comma separated list
+// of type names or numbers.
+func parseTypes(s string) []int {
+	var types []int
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if t, ok := TypeNames[name]; ok {
+			types = append(types, t)
+		} else if t, err := strconv.Atoi(name); err == nil {
+			types = append(types, t)
+		}
+	}
+
+	return types
+}
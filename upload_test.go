@@ -0,0 +1,170 @@
+package files
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+)
+
+// uploadRequest calls the action with a multipart upload of data
+// as the user with id 1 and the role, with the file id taken from
+// the last element of url.
+func uploadRequest(t *testing.T, action http.HandlerFunc, role, url, name string, data []byte) (*httptest.ResponseRecorder, fileResponse) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+
+	r := httptest.NewRequest("POST", url, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("id", "1")
+	r.Header.Set("role", role)
+	r = mux.SetURLVars(r, map[string]string{"id": path.Base(r.URL.Path)})
+
+	w := httptest.NewRecorder()
+	action(w, r)
+
+	var rsp fileResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatalf("Invalid response %s: %v", w.Body, err)
+	}
+
+	return w, rsp
+}
+
+// fileResponse is the json envelope of the file actions.
+type fileResponse struct {
+	Errors []core.ErrorMsg `json:"errors"`
+	Data   PublicFile      `json:"data"`
+}
+
+// storedFiles counts the files left in the temp dir and the storages.
+func storedFiles(t *testing.T, s *Service) int {
+	n := 0
+	err := filepath.Walk(s.Opts.TempDir, func(name string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestService(t, WithMaxUploadSize(int64(len(pic)-1)))
+
+	w, rsp := uploadRequest(t, s.actionUpload, "user", "/files", "a.png", pic)
+	if w.Code != http.StatusOK || len(rsp.Errors) != 1 || !strings.Contains(w.Body.String(), ErrFileTooLarge.Error()) {
+		t.Fatalf("Upload over the limit not rejected: %d %s", w.Code, w.Body)
+	}
+
+	var count int
+	s.App.DB.Model(&File{}).Count(&count)
+	if count != 0 || storedFiles(t, s) != 0 {
+		t.Errorf("Rejected upload stored: %d rows, %d files", count, storedFiles(t, s))
+	}
+
+	// exactly at the limit passes
+	s.Opts.MaxUploadSize++
+	if _, rsp := uploadRequest(t, s.actionUpload, "user", "/files", "a.png", pic); len(rsp.Errors) != 0 || rsp.Data.ID == 0 {
+		t.Errorf("Upload at the limit rejected: %+v", rsp)
+	}
+}
+
+func TestReUploadZeroValues(t *testing.T) {
+	s := newTestService(t)
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, rsp := uploadRequest(t, s.actionUpload, "user", "/files", "a.png", pic)
+	if len(rsp.Errors) != 0 || rsp.Data.Type != TypeImage {
+		t.Fatalf("Upload failed: %+v", rsp)
+	}
+	s.App.DB.Model(&File{}).Where("id = ?", rsp.Data.ID).Update("failure", "Old reason")
+
+	// an image replaced by private data, type other and no src are zero
+	url := fmt.Sprintf("/files/%d?visibility=private", rsp.Data.ID)
+	_, rsp = uploadRequest(t, s.actionReUpload, "user", url, "a.dat", []byte{0, 1, 2, 3, 0xfe, 0xff})
+	if len(rsp.Errors) != 0 {
+		t.Fatalf("Re-upload failed: %+v", rsp)
+	}
+
+	var file File
+	s.App.DB.First(&file, rsp.Data.ID)
+	if file.Type != TypeOther || file.Src != "" || file.Visibility != VisibilityPrivate ||
+		file.Mime == "image/png" || file.Failure != "" || len(file.Variants) != 0 {
+		t.Errorf("Old values kept: %+v", file)
+	}
+}
+
+func TestReUploadRollback(t *testing.T) {
+	// the endpoint is never called, deliveries are not run
+	s := newTestService(t, WithWebhook("http://127.0.0.1:1/hook", "secret"))
+	pic, err := ioutil.ReadFile("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, rsp := uploadRequest(t, s.actionUpload, "user", "/files", "a.png", pic)
+	if len(rsp.Errors) != 0 {
+		t.Fatalf("Upload failed: %+v", rsp)
+	}
+
+	var old File
+	s.App.DB.First(&old, rsp.Data.ID)
+	url := fmt.Sprintf("/files/%d", old.ID)
+
+	// the event can not be queued, the replace is rolled back
+	s.App.DB.DropTable(&WebhookDelivery{})
+
+	_, rsp = uploadRequest(t, s.actionReUpload, "user", url, "b.dat", []byte{0, 1, 2, 3, 0xfe, 0xff})
+	if len(rsp.Errors) == 0 || rsp.Data.Hash != old.Hash {
+		t.Fatalf("Failed re-upload answered %+v", rsp)
+	}
+
+	var file File
+	s.App.DB.First(&file, old.ID)
+	if file.Path != old.Path || file.Hash != old.Hash {
+		t.Errorf("Record replaced: %+v", file)
+	}
+	if _, err := s.Opts.Storage.Stat(old.Path); err != nil || storedFiles(t, s) != 1 {
+		t.Errorf("Wrong blobs after a rollback: %v, %d files", err, storedFiles(t, s))
+	}
+
+	s.App.DB.AutoMigrate(&WebhookDelivery{})
+
+	_, rsp = uploadRequest(t, s.actionReUpload, "user", url, "b.dat", []byte{0, 1, 2, 3, 0xfe, 0xff})
+	if len(rsp.Errors) != 0 {
+		t.Fatalf("Re-upload failed: %+v", rsp)
+	}
+	if _, err := s.Opts.Storage.Stat(old.Path); err == nil || storedFiles(t, s) != 1 {
+		t.Errorf("Old blob kept after the replace: %d files", storedFiles(t, s))
+	}
+}
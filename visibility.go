@@ -0,0 +1,151 @@
+package files
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-rest-framework/core"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+)
+
+var ErrVisibility = errors.New("Visibility must be public or private")
+
+// storageOf returns the storage keeping the file content.
+func (s *Service) storageOf(file File) Storage {
+	if file.Visibility == VisibilityPrivate {
+		return s.Opts.PrivateStorage
+	}
+
+	return s.Opts.Storage
+}
+
+// withURLs makes the urls of a file whose storage urls expire,
+// they are not saved so every read gets fresh ones.
+func (s *Service) withURLs(file *File) {
+	storage := s.storageOf(*file)
+	if e, ok := storage.(ExpiringURLs); !ok || !e.URLsExpire() || file.Path == "" {
+		return
+	}
+
+	file.Src = storage.URL(file.Path)
+	for name, v := range file.Variants {
+		v.Src = storage.URL(v.Path)
+		file.Variants[name] = v
+	}
+}
+
+// withOptionalAuth lets anonymous requests through, but checks the token
+// when one is sent, so handlers can trust the id and role headers.
+func (s *Service) withOptionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	protected := s.App.Protect(next, []string{"admin", "user"})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer")
+		if strings.TrimSpace(token) != "" {
+			protected(w, r)
+			return
+		}
+
+		r.Header.Del("id")
+		r.Header.Del("role")
+		next(w, r)
+	}
+}
+
+// visibleFiles limits db to the files the caller may see:
+// admins see everything, users their own private files too.
+func visibleFiles(db *gorm.DB, r *http.Request) *gorm.DB {
+	switch r.Header.Get("role") {
+	case "admin":
+		return db
+	case "user":
+		return db.Where("visibility <> ? OR user_id = ?", VisibilityPrivate, r.Header.Get("id"))
+	default:
+		return db.Where("visibility <> ?", VisibilityPrivate)
+	}
+}
+
+func canRead(r *http.Request, file File) bool {
+	if file.Visibility != VisibilityPrivate {
+		return true
+	}
+
+	role := r.Header.Get("role")
+	idstring := fmt.Sprintf("%d", file.UserID)
+	userid := r.Header.Get("id")
+
+	return role == "admin" || (role == "user" && idstring == userid)
+}
+
+func (s *Service) sign(file File, expires int64) string {
+	mac := hmac.New(sha256.New, s.Opts.SigningKey)
+	fmt.Fprintf(mac, "%d:%d", file.ID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature checks the expires and signature params of a share link.
+func (s *Service) validSignature(r *http.Request, file File) bool {
+	expires, err := strconv.ParseInt(r.FormValue("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(r.FormValue("signature")), []byte(s.sign(file, expires)))
+}
+
+type ShareLink struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// actionShare mints a signed link to the file content,
+// valid for "ttl" seconds (one hour by default).
+func (s *Service) actionShare(w http.ResponseWriter, r *http.Request) {
+	var (
+		file File
+		link ShareLink
+		rsp  = core.Response{Data: &link, Req: r}
+	)
+
+	vars := mux.Vars(r)
+	s.scoped(s.App.DB).First(&file, vars["id"])
+
+	if file.ID == 0 {
+		rsp.Errors.Add("ID", "File not found")
+	} else {
+		role := r.Header.Get("role")
+		idstring := fmt.Sprintf("%d", file.UserID)
+		userid := r.Header.Get("id")
+		if role == "admin" || (role == "user" && idstring == userid) {
+			ttl, err := strconv.Atoi(r.FormValue("ttl"))
+			if err != nil || ttl <= 0 {
+				ttl = 3600
+			}
+
+			expires := time.Now().Add(time.Duration(ttl) * time.Second)
+
+			link.Expires = expires
+			link.URL = fmt.Sprintf("%s/content?expires=%d&signature=%s",
+				strings.TrimSuffix(r.URL.Path, "/share"),
+				expires.Unix(),
+				s.sign(file, expires.Unix()))
+		} else {
+			rsp.Errors.Add("ID", "Only owner can share file")
+		}
+	}
+
+	w.Write(rsp.Make())
+}
@@ -0,0 +1,193 @@
+package files
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Webhook is an endpoint receiving the events "file.uploaded",
+// "file.replaced", "file.deleted", "attachment.created",
+// "attachment.updated" and "attachment.deleted" as signed json.
+type Webhook struct {
+	URL    string
+	Secret string
+	// Events limits the deliveries to the listed events, empty means all
+	Events []string
+}
+
+// WebhookPayload is the body posted to webhooks, signed by the
+// X-Webhook-Signature header ("sha256=" + hex hmac of the body).
+type WebhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery is a payload waiting in the outbox for its endpoint,
+// retried with exponential backoff until delivered or failed.
+type WebhookDelivery struct {
+	gorm.Model
+	URL         string     `json:"url"`
+	Event       string     `json:"event"`
+	Payload     string     `json:"payload" gorm:"type:text"`
+	Attempts    int        `json:"attempts"`
+	RunAt       time.Time  `json:"runAt" gorm:"index"`
+	LockedUntil *time.Time `json:"lockedUntil"`
+	FailedAt    *time.Time `json:"failedAt"`
+	Error       string     `json:"error" gorm:"type:text"`
+	Namespace   string     `json:"-" gorm:"type:varchar(100);not null;default:'';index"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (h Webhook) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Send posts the payload to the endpoint, any answer but 2xx is an error.
+func (h Webhook) Send(event string, payload []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Signature", SignWebhook(h.Secret, payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook answered %s", resp.Status)
+	}
+
+	return nil
+}
+
+// SignWebhook returns the X-Webhook-Signature of the payload.
+func SignWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook tells receivers if the signature of the payload is valid.
+func VerifyWebhook(secret string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(SignWebhook(secret, payload)))
+}
+
+// publish puts the event into the outbox of every webhook wanting it.
+// db is the transaction of the change, so the event is queued if and
+// only if the change is saved. Call notify after the commit.
+func (s *Service) publish(db *gorm.DB, event string, data interface{}) error {
+	if len(s.Opts.Webhooks) == 0 {
+		return nil
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(WebhookPayload{
+		ID:        hex.EncodeToString(id),
+		Event:     event,
+		CreatedAt: time.Now(),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range s.Opts.Webhooks {
+		if !h.wants(event) {
+			continue
+		}
+
+		err := db.Create(&WebhookDelivery{
+			URL:       h.URL,
+			Event:     event,
+			Payload:   string(payload),
+			RunAt:     time.Now(),
+			Namespace: s.Opts.Namespace,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) webhookFor(url string) (Webhook, bool) {
+	for _, h := range s.Opts.Webhooks {
+		if h.URL == url {
+			return h, true
+		}
+	}
+
+	return Webhook{}, false
+}
+
+// runNextDelivery claims and sends one due delivery, it reports
+// false when there is nothing to do.
+func (s *Service) runNextDelivery() bool {
+	var d WebhookDelivery
+
+	found, claimed := claim(s.scoped(s.App.DB).Where("failed_at IS NULL"), &d, time.Minute)
+	if !claimed {
+		return found
+	}
+
+	h, ok := s.webhookFor(d.URL)
+	if !ok {
+		// the endpoint was removed from the config
+		s.App.DB.Unscoped().Delete(&d)
+		return true
+	}
+
+	err := h.Send(d.Event, []byte(d.Payload))
+	if err == nil {
+		s.App.DB.Unscoped().Delete(&d)
+		return true
+	}
+
+	d.Attempts++
+	if d.Attempts >= s.Opts.WebhookAttempts {
+		s.App.DB.Model(&d).Updates(map[string]interface{}{
+			"attempts":     d.Attempts,
+			"failed_at":    time.Now(),
+			"locked_until": nil,
+			"error":        err.Error(),
+		})
+		return true
+	}
+
+	retry(s.App.DB, &d, d.Attempts, s.Opts.WebhookRetryDelay, err)
+
+	return true
+}
@@ -0,0 +1,105 @@
+package files
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookOutbox(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies [][]byte
+	)
+
+	// the receiver fails the first delivery
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !VerifyWebhook("secret", body, r.Header.Get("X-Webhook-Signature")) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, body)
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	s := newTestService(t,
+		WithWebhook(srv.URL, "secret", "file.uploaded"),
+		WithWebhookRetries(3, time.Millisecond),
+	)
+
+	pic, err := os.Open("test_pic1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pic.Close()
+
+	file, err := s.Save(context.Background(), 1, "a.png", pic, SaveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d WebhookDelivery
+	s.App.DB.First(&d)
+	if d.ID == 0 || d.Event != "file.uploaded" || d.URL != srv.URL {
+		t.Fatalf("Upload not queued in the outbox: %+v", d)
+	}
+
+	if !s.runNextDelivery() {
+		t.Fatal("Due delivery not run")
+	}
+
+	s.App.DB.First(&d, d.ID)
+	if d.Attempts != 1 || d.Error == "" || d.LockedUntil != nil || d.FailedAt != nil {
+		t.Fatalf("Failed delivery not scheduled for retry: %+v", d)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if !s.runNextDelivery() {
+		t.Fatal("Retry not run")
+	}
+
+	var left int
+	s.App.DB.Model(&WebhookDelivery{}).Count(&left)
+	if left != 0 {
+		t.Errorf("Delivered payload left in the outbox: %d", left)
+	}
+
+	if s.runNextDelivery() {
+		t.Error("Nothing left to deliver")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(bodies) != 2 || string(bodies[0]) != string(bodies[1]) {
+		t.Fatalf("The retry must send the same payload: %q", bodies)
+	}
+
+	var payload struct {
+		Event string `json:"event"`
+		Data  struct {
+			ID uint `json:"ID"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(bodies[1], &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Event != "file.uploaded" || payload.Data.ID != file.ID {
+		t.Errorf("Wrong payload: %s", bodies[1])
+	}
+}